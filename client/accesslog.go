@@ -0,0 +1,157 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	ACCESS_JSON     = "json"
+	ACCESS_COMBINED = "combined"
+)
+
+// AccessEntry is one access log line of a tunneled connection or request.
+type AccessEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Port     string    `json:"port"`
+	User     string    `json:"user,omitempty"`
+	Method   string    `json:"method"`
+	Target   string    `json:"target"`
+	Server   string    `json:"server"` // server host, direct or -
+	Status   int       `json:"status"`
+	Up       int64     `json:"up"`
+	Down     int64     `json:"down"`
+	Duration float64   `json:"duration_ms"`
+	Action   string    `json:"action"`
+	Rule     string    `json:"rule,omitempty"`
+}
+
+// AccessLogConfig configures the access log sink.
+type AccessLogConfig struct {
+	Sink       string // stderr, syslog, syslog:<socket> or a file
+	Format     string // json or combined
+	MaxSize    int    // megabytes before rotating the file
+	MaxBackups int    // rotated files to keep, 0 keeps all
+	MaxAge     int    // days to keep rotated files, 0 keeps all
+}
+
+// AccessLog writes one line per tunneled connection, separated from the
+// diagnostic log. A nil AccessLog logs nothing.
+type AccessLog struct {
+	format string
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+func OpenAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	switch cfg.Format {
+	case "":
+		cfg.Format = ACCESS_JSON
+	case ACCESS_JSON, ACCESS_COMBINED:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+
+	var w io.Writer
+	switch {
+	case cfg.Sink == "stderr":
+		w = os.Stderr
+	case cfg.Sink == "syslog" || strings.HasPrefix(cfg.Sink, "syslog:"):
+		var err error
+		if w, err = openSyslog(strings.TrimPrefix(strings.TrimPrefix(cfg.Sink, "syslog"), ":")); err != nil {
+			return nil, err
+		}
+	default:
+		w = &lumberjack.Logger{
+			Filename:   cfg.Sink,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+		}
+	}
+	return &AccessLog{format: cfg.Format, w: w}, nil
+}
+
+func (l *AccessLog) Log(e *AccessEntry) {
+	if l == nil {
+		return
+	}
+	var line []byte
+	if l.format == ACCESS_COMBINED {
+		line = []byte(e.combined())
+	} else {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		log.WithError(err).Debugln("write access log")
+	}
+}
+
+// combined is the Combined Log Format followed by the wsh fields.
+func (e *AccessEntry) combined() string {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	rule := e.Rule
+	if rule == "" {
+		rule = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s HTTP/1.1\" %d %d \"-\" \"-\" port=%s server=%s up=%d duration=%.3fms action=%s rule=%s\n",
+		remoteIP(e.Client), user, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.Target,
+		e.Status, e.Down, e.Port, e.Server, e.Up, e.Duration, e.Action, strconv.Quote(rule))
+}
+
+// logAccess completes e with the listener fields and writes it.
+func (client *Client) logAccess(start time.Time, e *AccessEntry) {
+	if client.AccessLog == nil {
+		return
+	}
+	e.Time = start
+	e.Port = client.Port
+	e.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+	switch e.Action {
+	case DIRECT.String():
+		e.Server = "direct"
+	case REJECT.String():
+		e.Server = "-"
+	default:
+		e.Server = client.ServerUrl.Host
+	}
+	client.AccessLog.Log(e)
+}
+
+// statusSniffer reads the status code of a HTTP/1.x response stream.
+type statusSniffer struct {
+	r      io.Reader
+	head   []byte
+	Status int
+}
+
+func (s *statusSniffer) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if s.Status == 0 && len(s.head) < 12 {
+		if m := 12 - len(s.head); n > m {
+			s.head = append(s.head, p[:m]...)
+		} else {
+			s.head = append(s.head, p[:n]...)
+		}
+		// HTTP/1.1 200
+		if len(s.head) >= 12 && strings.HasPrefix(string(s.head), "HTTP/1.") {
+			s.Status, _ = strconv.Atoi(string(s.head[9:12]))
+		}
+	}
+	return n, err
+}
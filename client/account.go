@@ -0,0 +1,408 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic is bytes counted in both directions.
+type Traffic struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+func (t Traffic) Total() int64 { return t.Up + t.Down }
+
+// Counters aggregates traffic of one period. IPs and hosts are only counted
+// per day and month, the total would grow without bound.
+type Counters struct {
+	Period    string              `json:"period,omitempty"`
+	Listeners map[string]*Traffic `json:"listeners"`
+	IPs       map[string]*Traffic `json:"ips,omitempty"`
+	Users     map[string]*Traffic `json:"users"`
+	Hosts     map[string]*Traffic `json:"hosts,omitempty"`
+	Quotas    map[string]*Traffic `json:"quotas,omitempty"` // by HostQuota pattern
+}
+
+const (
+	// maxCounterKeys caps each map of Counters, later keys are counted
+	// under otherKey.
+	maxCounterKeys = 10000
+	otherKey       = "(other)"
+
+	// a stream adds its traffic to the Accountant and checks quotas after
+	// accountBytes or accountInterval, and when it ends.
+	accountBytes    = 256 << 10
+	accountInterval = time.Second
+)
+
+func newCounters(period string) *Counters {
+	return &Counters{
+		Period:    period,
+		Listeners: make(map[string]*Traffic),
+		IPs:       make(map[string]*Traffic),
+		Users:     make(map[string]*Traffic),
+		Hosts:     make(map[string]*Traffic),
+		Quotas:    make(map[string]*Traffic),
+	}
+}
+
+func (cs *Counters) add(port, ip, user, host, pattern string, t Traffic) {
+	addTraffic(&cs.Listeners, port, t)
+	addTraffic(&cs.IPs, ip, t)
+	addTraffic(&cs.Users, user, t)
+	addTraffic(&cs.Hosts, host, t)
+	addTraffic(&cs.Quotas, pattern, t)
+}
+
+// addTotal is add without ips and hosts.
+func (cs *Counters) addTotal(port, user, pattern string, t Traffic) {
+	addTraffic(&cs.Listeners, port, t)
+	addTraffic(&cs.Users, user, t)
+	addTraffic(&cs.Quotas, pattern, t)
+}
+
+func addTraffic(mp *map[string]*Traffic, key string, t Traffic) {
+	if key == "" {
+		return
+	}
+	if *mp == nil { // saved before the map was added
+		*mp = make(map[string]*Traffic)
+	}
+	m := *mp
+	sum, ok := m[key]
+	if !ok && len(m) >= maxCounterKeys {
+		key = otherKey
+		sum, ok = m[key]
+	}
+	if !ok {
+		sum = new(Traffic)
+		m[key] = sum
+	}
+	sum.Up += t.Up
+	sum.Down += t.Down
+}
+
+// Quota in bytes of up and down, zero means unlimited.
+type Quota struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+type HostQuota struct {
+	Pattern string `json:"pattern"` // path.Match pattern of the destination host
+	Quota
+}
+
+// QuotaConfig is the json config of quotas.
+//
+// Users are the names of Proxy-Authorization basic credentials, which the
+// client does not verify. User quotas are advisory: a local client can avoid
+// its quota by sending another name.
+//
+// A host quota is shared by all hosts matching its pattern, its traffic is
+// counted from the time the pattern is configured.
+type QuotaConfig struct {
+	Users map[string]Quota `json:"users"`
+	Hosts []HostQuota      `json:"hosts"` // first match
+}
+
+func LoadQuotaConfig(name string) (*QuotaConfig, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg QuotaConfig
+	if err = json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+type accountState struct {
+	Total *Counters `json:"total"`
+	Day   *Counters `json:"day"`
+	Month *Counters `json:"month"`
+}
+
+// Accountant counts traffic of every tunneled connection and checks quotas.
+// Counters are saved to File.
+type Accountant struct {
+	File string
+
+	mu     sync.Mutex
+	state  accountState
+	quotas QuotaConfig
+}
+
+// NewAccountant loads saved counters from file if it exists.
+func NewAccountant(file string, quotas *QuotaConfig) (*Accountant, error) {
+	a := &Accountant{File: file}
+	if quotas != nil {
+		a.quotas = *quotas
+	}
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err = json.Unmarshal(b, &a.state); err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	if a.state.Total == nil {
+		a.state.Total = newCounters("")
+	}
+	// saved by versions counting them in the total
+	a.state.Total.IPs, a.state.Total.Hosts = nil, nil
+	a.rotate(time.Now())
+	return a, nil
+}
+
+// rotate starts new day/month counters when the period changed.
+func (a *Accountant) rotate(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if a.state.Day == nil || a.state.Day.Period != day {
+		a.state.Day = newCounters(day)
+	}
+	if a.state.Month == nil || a.state.Month.Period != month {
+		a.state.Month = newCounters(month)
+	}
+}
+
+func (a *Accountant) SetQuotas(quotas *QuotaConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.quotas = *quotas
+}
+
+// Check returns a 403 ProxyError when user or host is over quota.
+func (a *Accountant) Check(user, host string) *ProxyError {
+	if a == nil {
+		return nil
+	}
+	host = hostNoPort(host)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rotate(time.Now())
+	return a.check(user, host)
+}
+
+// check is Check with the host without port, the caller holds a.mu.
+func (a *Accountant) check(user, host string) *ProxyError {
+	if q, ok := a.quotas.Users[user]; ok && user != "" {
+		if pe := a.exceeded(q, a.state.Day.Users[user], a.state.Month.Users[user], "user "+user); pe != nil {
+			return pe
+		}
+	}
+	if hq := a.hostQuota(host); hq != nil {
+		return a.exceeded(hq.Quota, a.state.Day.Quotas[hq.Pattern], a.state.Month.Quotas[hq.Pattern], "host "+hq.Pattern)
+	}
+	return nil
+}
+
+// hostQuota is the first HostQuota matching host, the caller holds a.mu.
+func (a *Accountant) hostQuota(host string) *HostQuota {
+	for i, hq := range a.quotas.Hosts {
+		if ok, _ := path.Match(hq.Pattern, host); ok {
+			return &a.quotas.Hosts[i]
+		}
+	}
+	return nil
+}
+
+func (a *Accountant) exceeded(q Quota, day, month *Traffic, who string) *ProxyError {
+	if q.Daily > 0 && day != nil && day.Total() >= q.Daily {
+		return newProxyError(http.StatusForbidden, PS_HTTP_REQUEST_DENIED,
+			fmt.Sprintf("daily quota of %d bytes exceeded for %s", q.Daily, who))
+	}
+	if q.Monthly > 0 && month != nil && month.Total() >= q.Monthly {
+		return newProxyError(http.StatusForbidden, PS_HTTP_REQUEST_DENIED,
+			fmt.Sprintf("monthly quota of %d bytes exceeded for %s", q.Monthly, who))
+	}
+	return nil
+}
+
+// Add counts traffic of a stream.
+func (a *Accountant) Add(port, ip, user, host string, t Traffic) {
+	a.record(port, ip, user, host, t)
+}
+
+// record adds t and checks the quotas of user and host in one lock.
+func (a *Accountant) record(port, ip, user, host string, t Traffic) *ProxyError {
+	if a == nil {
+		return nil
+	}
+	host = hostNoPort(host)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rotate(time.Now())
+	var pattern string
+	if hq := a.hostQuota(host); hq != nil {
+		pattern = hq.Pattern
+	}
+	a.state.Total.addTotal(port, user, pattern, t)
+	a.state.Day.add(port, ip, user, host, pattern, t)
+	a.state.Month.add(port, ip, user, host, pattern, t)
+	return a.check(user, host)
+}
+
+// Snapshot returns the counters as json.
+func (a *Accountant) Snapshot() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return json.MarshalIndent(&a.state, "", "  ")
+}
+
+func (a *Accountant) Save() error {
+	if a.File == "" {
+		return nil
+	}
+	b, err := a.Snapshot()
+	if err != nil {
+		return err
+	}
+	tmp := a.File + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.File)
+}
+
+// SaveEvery saves counters every period, it never returns.
+func (a *Accountant) SaveEvery(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.Save(); err != nil {
+			log.WithError(err).Errorln("save traffic counters")
+		}
+	}
+}
+
+// streamCount counts bytes of one stream. After account, the bytes are also
+// added to the Accountant every accountBytes or accountInterval, and reads
+// fail once over quota. flush adds the rest when the stream ends.
+type streamCount struct {
+	up   int64
+	down int64
+
+	pendingUp   int64
+	pendingDown int64
+	flushed     int64 // unix nano
+
+	acct                 *Accountant
+	port, ip, user, host string
+}
+
+func (sc *streamCount) account(a *Accountant, port, ip, user, host string) {
+	sc.acct, sc.port, sc.ip, sc.user, sc.host = a, port, ip, user, host
+	atomic.StoreInt64(&sc.flushed, time.Now().UnixNano())
+}
+
+func (sc *streamCount) UpReader(r io.Reader) io.Reader {
+	return &countReader{r, sc, true}
+}
+
+func (sc *streamCount) DownReader(r io.Reader) io.Reader {
+	return &countReader{r, sc, false}
+}
+
+func (sc *streamCount) Traffic() Traffic {
+	return Traffic{Up: atomic.LoadInt64(&sc.up), Down: atomic.LoadInt64(&sc.down)}
+}
+
+func (sc *streamCount) add(n int, up bool) error {
+	if n == 0 {
+		return nil
+	}
+	if up {
+		atomic.AddInt64(&sc.up, int64(n))
+	} else {
+		atomic.AddInt64(&sc.down, int64(n))
+	}
+	if sc.acct == nil {
+		return nil
+	}
+	var pending int64
+	if up {
+		pending = atomic.AddInt64(&sc.pendingUp, int64(n)) + atomic.LoadInt64(&sc.pendingDown)
+	} else {
+		pending = atomic.AddInt64(&sc.pendingDown, int64(n)) + atomic.LoadInt64(&sc.pendingUp)
+	}
+	if pending < accountBytes && time.Now().UnixNano()-atomic.LoadInt64(&sc.flushed) < int64(accountInterval) {
+		return nil
+	}
+	if pe := sc.flush(); pe != nil {
+		return pe
+	}
+	return nil
+}
+
+// flush adds the pending traffic to the Accountant and checks the quotas.
+func (sc *streamCount) flush() *ProxyError {
+	if sc.acct == nil {
+		return nil
+	}
+	atomic.StoreInt64(&sc.flushed, time.Now().UnixNano())
+	t := Traffic{Up: atomic.SwapInt64(&sc.pendingUp, 0), Down: atomic.SwapInt64(&sc.pendingDown, 0)}
+	if t.Total() == 0 {
+		return nil
+	}
+	return sc.acct.record(sc.port, sc.ip, sc.user, sc.host, t)
+}
+
+type countReader struct {
+	r  io.Reader
+	sc *streamCount
+	up bool
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if qerr := r.sc.add(n, r.up); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
+
+// proxyUser is the user name of the Proxy-Authorization basic credentials.
+// The password is not checked, so the name only labels traffic.
+func proxyUser(h http.Header) string {
+	auth := h.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return ""
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return ""
+	}
+	user := string(b)
+	if i := strings.IndexByte(user, ':'); i >= 0 {
+		user = user[:i]
+	}
+	return user
+}
+
+func hostNoPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
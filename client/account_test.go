@@ -0,0 +1,53 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func TestStreamCountFlush(t *testing.T) {
+	a, err := NewAccountant("", &QuotaConfig{Hosts: []HostQuota{{Pattern: "*.example.com", Quota: Quota{Daily: 1 << 20}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sc streamCount
+	sc.account(a, "1080", "10.0.0.1", "", "www.example.com:443")
+
+	// below accountBytes nothing reaches the Accountant before flush
+	io.CopyN(ioutil.Discard, sc.DownReader(bytes.NewReader(make([]byte, 1000))), 1000)
+	if got := a.state.Day.Hosts["www.example.com"]; got != nil {
+		t.Fatalf("counted %+v before flush", got)
+	}
+	sc.flush()
+	if got := a.state.Day.Quotas["*.example.com"]; got == nil || got.Down != 1000 {
+		t.Fatalf("quota counter %+v, want 1000 down", got)
+	}
+	if a.state.Total.Hosts != nil || a.state.Total.IPs != nil {
+		t.Error("total counts hosts or ips")
+	}
+
+	// the quota fails the read at a flush
+	_, err = io.Copy(ioutil.Discard, sc.DownReader(bytes.NewReader(make([]byte, 2<<20))))
+	if _, ok := err.(*ProxyError); !ok {
+		t.Fatalf("copy over quota: %v", err)
+	}
+	if n := sc.Traffic().Down; n > 1<<20+2*accountBytes {
+		t.Errorf("read %d bytes over a quota of %d", n, 1<<20)
+	}
+}
+
+func TestCounterKeysCapped(t *testing.T) {
+	var m map[string]*Traffic
+	for i := 0; i < maxCounterKeys+10; i++ {
+		addTraffic(&m, strconv.Itoa(i), Traffic{Up: 1})
+	}
+	if len(m) != maxCounterKeys+1 {
+		t.Fatalf("%d keys, want %d", len(m), maxCounterKeys+1)
+	}
+	if m[otherKey].Up != 10 {
+		t.Errorf("other %d, want 10", m[otherKey].Up)
+	}
+}
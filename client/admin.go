@@ -0,0 +1,316 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ADMIN_HEADER MUST be set on requests changing state, browsers can not send
+// it cross-origin without a preflight, which the api never allows.
+const ADMIN_HEADER = "X-Wsh-Admin"
+
+// Admin serves the JSON status and control api of all listeners. It MUST
+// only listen on loopback or a unix socket, there is no authentication.
+// Requests from browsers are refused: the Host must be the listen address,
+// Origin must not be set, and methods other than GET need ADMIN_HEADER.
+//
+//	GET    /listeners       listeners with their tunnels and ServerInfo
+//	GET    /streams         active streams
+//	DELETE /streams/<id>    close a stream
+//	GET    /errors          recent errors
+//	GET    /traffic         traffic counters of the Accountant
+//	POST   /reconnect       close tunnels of all or ?port= listeners
+//	POST   /reload          reload config
+//	GET    /loglevel        current log level
+//	PUT    /loglevel        set log level, body is {"level":"debug"}
+//	GET    /shaper          bandwidth limits
+//	PUT    /shaper          replace bandwidth limits with a ShaperConfig
+//	GET    /metrics         prometheus metrics
+type Admin struct {
+	Addr       string // like 127.0.0.1:7770 or unix:/run/wsh.sock
+	Clients    []*Client
+	Shaper     *Shaper      // optional
+	Accountant *Accountant  // optional
+	Reload     func() error // optional
+
+	mux *http.ServeMux
+}
+
+// Handler returns the api handler, more handlers could be added to it.
+func (a *Admin) Handler() *http.ServeMux {
+	if a.mux == nil {
+		a.mux = http.NewServeMux()
+		a.mux.HandleFunc("/listeners", a.listeners)
+		a.mux.HandleFunc("/streams", a.streams)
+		a.mux.HandleFunc("/streams/", a.closeStream)
+		a.mux.HandleFunc("/errors", a.errors)
+		a.mux.HandleFunc("/traffic", a.traffic)
+		a.mux.HandleFunc("/reconnect", a.reconnect)
+		a.mux.HandleFunc("/reload", a.reload)
+		a.mux.HandleFunc("/loglevel", a.logLevel)
+		a.mux.HandleFunc("/shaper", a.shaper)
+		a.mux.Handle("/metrics", promhttp.Handler())
+	}
+	return a.mux
+}
+
+// guard refuses requests of web pages, like cross-site requests and dns
+// rebinding.
+func (a *Admin) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Origin") != "":
+			writeJSONError(w, http.StatusForbidden, "cross-origin requests are not allowed")
+		case !a.isAdminHost(r.Host):
+			writeJSONError(w, http.StatusForbidden, "host is not the admin address")
+		case r.Method != "GET" && r.Method != "HEAD" && r.Header.Get(ADMIN_HEADER) == "":
+			writeJSONError(w, http.StatusForbidden, ADMIN_HEADER+" header is required")
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// isAdminHost reports whether host names the listen address. Any host is
+// accepted on a unix socket, which browsers can not reach.
+func (a *Admin) isAdminHost(host string) bool {
+	if strings.HasPrefix(a.Addr, "unix:") || host == a.Addr {
+		return true
+	}
+	_, port, err := net.SplitHostPort(a.Addr)
+	if err != nil {
+		return false
+	}
+	h, p, err := net.SplitHostPort(host)
+	if err != nil || p != port {
+		return false
+	}
+	ip := net.ParseIP(h)
+	return h == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// Listen listens on Addr, tcp addresses MUST be loopback.
+func (a *Admin) Listen() (net.Listener, error) {
+	if strings.HasPrefix(a.Addr, "unix:") {
+		file := strings.TrimPrefix(a.Addr, "unix:")
+		// remove a stale socket, never other files
+		if fi, err := os.Lstat(file); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("admin: %s exists and is not a socket", file)
+			}
+			if err = os.Remove(file); err != nil {
+				return nil, err
+			}
+		}
+		l, err := net.Listen("unix", file)
+		if err != nil {
+			return nil, err
+		}
+		// owner only, the umask is process wide so it is left alone
+		if err = os.Chmod(file, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(a.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin MUST listen on loopback: %s", a.Addr)
+	}
+	return net.Listen("tcp", a.Addr)
+}
+
+func (a *Admin) ListenAndServe() error {
+	l, err := a.Listen()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.WithField("addr", a.Addr).Infoln("admin api started")
+	return http.Serve(l, a.guard(a.Handler()))
+}
+
+func (a *Admin) listeners(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	status := make([]ListenerStatus, 0, len(a.Clients))
+	for _, c := range a.Clients {
+		status = append(status, c.Status())
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (a *Admin) streams(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	streams := []Stream{}
+	for _, c := range a.Clients {
+		streams = append(streams, c.Streams()...)
+	}
+	writeJSON(w, http.StatusOK, streams)
+}
+
+func (a *Admin) closeStream(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "DELETE") {
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/streams/"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad stream id")
+		return
+	}
+	for _, c := range a.Clients {
+		if c.CloseStream(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "no such stream")
+}
+
+func (a *Admin) errors(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, RecentErrors())
+}
+
+func (a *Admin) traffic(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	if a.Accountant == nil {
+		writeJSONError(w, http.StatusNotFound, "traffic accounting is disabled")
+		return
+	}
+	b, err := a.Accountant.Snapshot()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (a *Admin) reconnect(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	port := r.URL.Query().Get("port")
+	found := false
+	for _, c := range a.Clients {
+		if port == "" || c.Port == port {
+			c.Reconnect()
+			found = true
+		}
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "no such listener")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) reload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	if a.Reload == nil {
+		writeJSONError(w, http.StatusNotImplemented, "nothing to reload")
+		return
+	}
+	if err := a.Reload(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+func (a *Admin) logLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, logLevelBody{log.Level.String()})
+	case "PUT":
+		var body logLevelBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		level, err := logrus.ParseLevel(body.Level)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		SetLogLevel(level)
+		logrus.SetLevel(level)
+		log.Infoln("log level set to", level)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		allowMethod(w, r, "GET", "PUT")
+	}
+}
+
+func (a *Admin) shaper(w http.ResponseWriter, r *http.Request) {
+	if a.Shaper == nil {
+		writeJSONError(w, http.StatusNotFound, "bandwidth limits are disabled")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, a.Shaper.Config())
+	case "PUT":
+		var cfg ShaperConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a.Shaper.Reload(&cfg)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		allowMethod(w, r, "GET", "PUT")
+	}
+}
+
+// allowMethod writes 405 if the method of r is not one of methods.
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.WithError(err).Debugln("write admin response")
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -22,6 +23,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -44,21 +46,72 @@ func SetLogLevel(level logrus.Level) {
 type Client struct {
 	Port       string
 	ServerUrl  *url.URL
-	PingPeriod time.Duration
+	TLSConfig  *tls.Config   // optional, accept tls from local clients
+	PingPeriod time.Duration // of websocket pings, 0 to disable
 	Dialer     websocket.Dialer
+	RootCAs    *x509.CertPool // optional, verifies the inner tls of ws instead of the system roots
+	Token      string         // optional, sent as a bearer token on the websocket upgrade
 	BufSize    int
 	PacTpl     *template.Template
 
+	PacSource   string        // local file or url of the pac, the server if empty
+	PacCacheDir string        // keeps the last fetched pac, no cache if empty
+	PacMaxAge   time.Duration // Cache-Control of the served pac, no-cache if 0
+
+	// Limits of the listener, zero means no limit.
+	MaxConns          int           // max concurrent conns, each local h2 stream counts as one
+	QueueTimeout      time.Duration // wait for a free slot before 503
+	ReadHeaderTimeout time.Duration // for the initial request
+	IdleTimeout       time.Duration // close CONNECT streams after inactivity
+
+	Shaper     *Shaper     // optional, shared by all listeners
+	Accountant *Accountant // optional, shared by all listeners
+	Router     *Router     // optional, PROXY everything if nil
+	EvalPac    bool        // route by the pac when no rule matched
+	FakeIP     *FakeIPPool // optional, maps fake ips of the dns server back
+	AccessLog  *AccessLog  // optional, shared by all listeners
+	Capture    *Capture    // optional, records HAR of the reverse path
+
+	PropagateTrace bool   // send the trace context to the server
+	RecordDir      string // records the h2 frames of server conns
+	ReplayAddr     string // dial a ReplayServer instead of the server
+
+	pacEval    *PacEvaluator
+	pacVersion string     // of the loaded pac, by RefreshPac
+	muReload   sync.Mutex // serializes ReloadPac, guards pacVersion
+	muPac      sync.RWMutex
+
+	connSem chan struct{}
+
 	h2Transport  http.RoundTripper
+	h2           *http2.Transport // starts h2 on conns of the connPool
 	h2ReverseReq http.Request
 
-	serverInfo   *ServerInfo
-	muServerInfo sync.Mutex
+	// ServerInfoTTL refetches the ServerInfo on a conn after it, 0 fetches
+	// only on new conns. OnServerInfo is called with the old and the new
+	// ServerInfo when it changed, old is nil for the first, optional.
+	ServerInfoTTL time.Duration
+	OnServerInfo  func(old, info *ServerInfo)
+
+	serverInfo serverInfoState
+
+	// MaxMissedPongs closes the websocket after missed pongs in a row,
+	// faster than the timeout of HOST_OK. 0 never closes.
+	MaxMissedPongs int
+
+	rtt rttStats
+
+	streams  map[uint64]*activeStream
+	tunnels  map[uint64]*Tunnel
+	muStatus sync.Mutex
 }
 
 func (client *Client) PreRun() {
 	client.initReverseRequest()
 	client.h2Transport = client.newH2Transport()
+	if client.MaxConns > 0 {
+		client.connSem = make(chan struct{}, client.MaxConns)
+	}
 }
 
 func (client *Client) Run() error {
@@ -66,9 +119,13 @@ func (client *Client) Run() error {
 	if err != nil {
 		return err
 	}
-	defer l.Close()
 	fmt.Println(">>>>>>>>>>>>>>> OK proxy is on port", client.Port)
+	return client.Serve(l)
+}
 
+// Serve accepts the local conns of l, it closes l when it returns.
+func (client *Client) Serve(l net.Listener) error {
+	defer l.Close()
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		c, e := l.Accept()
@@ -89,6 +146,7 @@ func (client *Client) Run() error {
 			return e
 		}
 		tempDelay = 0
+		acceptedConns.WithLabelValues(client.Port).Inc()
 		go client.connect(c)
 	}
 }
@@ -96,6 +154,8 @@ func (client *Client) Run() error {
 func (client *Client) newH2Transport() http.RoundTripper {
 	tlsConfig := tls.Config{
 		InsecureSkipVerify: os.Getenv("TEST_MODE") == "1",
+		RootCAs:            client.RootCAs,
+		NextProtos:         []string{http2.NextProtoTLS},
 	}
 
 	if client.ServerUrl.Scheme == "tcp" {
@@ -117,9 +177,13 @@ func (client *Client) newH2Transport() http.RoundTripper {
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	return &http2.Transport{
+	client.h2 = &http2.Transport{
 		TLSClientConfig: &tlsConfig,
-		DialTLS:         client.DialProxyTLS,
+		ConnPool:        &connPool{client: client},
+	}
+	return &instrumentedTransport{
+		RoundTripper: client.h2,
+		client:       client,
 	}
 }
 
@@ -138,20 +202,67 @@ func (client *Client) initReverseRequest() {
 	}
 }
 
-// Extract target host, we only need that. The request is replayed to proxy server.
-// The underline url is pointing to proxy server.
-func (client *Client) newReverseRequest(requestURI string) (*http.Request, *url.URL, error) {
-	reqUrl, err := url.ParseRequestURI(requestURI)
-	if err != nil {
-		return nil, nil, err
+// newConnectRequest tunnels to target through the server.
+func (client *Client) newConnectRequest(target string) *http.Request {
+	return &http.Request{
+		Method:        "CONNECT",
+		URL:           &url.URL{Scheme: "https", Host: client.ServerUrl.Host},
+		Host:          target,
+		Header:        make(http.Header),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		ContentLength: -1,
+	}
+}
+
+// SetPac sets the pac template, and compiles it for routing when EvalPac.
+func (client *Client) SetPac(tpl *template.Template) error {
+	var eval *PacEvaluator
+	if client.EvalPac {
+		var err error
+		if eval, err = NewPacEvaluator(tpl, "127.0.0.1:"+client.Port); err != nil {
+			return err
+		}
 	}
+	client.muPac.Lock()
+	defer client.muPac.Unlock()
+	client.PacTpl = tpl
+	client.pacEval = eval
+	return nil
+}
 
-	req := client.h2ReverseReq
-	u := *req.URL
-	req.URL = &u
-	req.Header = make(http.Header)
-	req.Host, _ = hostPortNoPort(reqUrl) // => authority|target
-	return &req, reqUrl, nil
+func (client *Client) Pac() *template.Template {
+	client.muPac.RLock()
+	defer client.muPac.RUnlock()
+	return client.PacTpl
+}
+
+// Route decides by the Router rules first, then by the pac when EvalPac.
+func (client *Client) Route(target string) (Action, *Rule) {
+	action, rule := client.Router.Route(target)
+	if rule != nil {
+		return action, rule
+	}
+	client.muPac.RLock()
+	eval := client.pacEval
+	client.muPac.RUnlock()
+	if eval != nil {
+		return eval.Route(target)
+	}
+	return PROXY, nil
+}
+
+// traceRoute is Route in a span of ctx.
+func (client *Client) traceRoute(ctx context.Context, target string) (Action, *Rule) {
+	_, span := startSpan(ctx, "route", attribute.String("wsh.target", target))
+	defer span.End()
+	action, rule := client.Route(target)
+	span.SetAttributes(attribute.String("wsh.action", action.String()))
+	if rule != nil {
+		span.SetAttributes(attribute.String("wsh.rule", rule.String()))
+	}
+	return action, rule
 }
 
 // golang/x/net/http2
@@ -169,76 +280,170 @@ func (client *Client) connect(c net.Conn) {
 		}
 	}()
 	defer c.Close()
-
+	start := time.Now()
+	ctx, span := startSpan(context.Background(), "accept",
+		attribute.String("wsh.port", client.Port),
+		attribute.String("net.peer.addr", c.RemoteAddr().String()))
+	defer span.End()
+
+	if client.ReadHeaderTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(client.ReadHeaderTimeout))
+	}
 	bufConn := bufio.NewReader(c)
+	if client.TLSConfig != nil && isTLSHandshake(bufConn) {
+		tc := tls.Server(&bufferedConn{c, bufConn}, client.TLSConfig)
+		if err := tc.Handshake(); err != nil {
+			log.WithError(err).Debugln("local tls handshake")
+			return
+		}
+		if tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			c.SetReadDeadline(time.Time{})
+			client.serveH2(tc)
+			return
+		}
+		c = tc
+		bufConn = bufio.NewReader(tc)
+	}
+
 	requestLine, err := peekRequestLine(bufConn)
 	if err != nil {
 		return
 	}
+	if string(requestLine) == h2PrefaceLine {
+		c.SetReadDeadline(time.Time{})
+		client.serveH2(&bufferedConn{c, bufConn})
+		return
+	}
+	if pe := client.acquire(); pe != nil {
+		pe.Write(c)
+		return
+	}
+	defer client.release()
 
 	// connect or reverse
+	_, parseSpan := startSpan(ctx, "parse request")
+	defer parseSpan.End() // ended below if parsed
 	method, requestURI, _, ok := parseRequestLine(string(requestLine))
 	if !ok {
 		return
 	}
 	isConnect := method == "CONNECT"
 
-	var req *http.Request
+	var target, user string
 	if isConnect {
-		if req, err = http.ReadRequest(bufConn); err != nil {
+		req, err := http.ReadRequest(bufConn)
+		if err != nil {
 			log.WithError(err).Debugln(requestURI)
-			c.Write([]byte("HTTP/1.1 400 Bad Request Connect\r\n\r\n"))
+			newProxyError(http.StatusBadRequest, PS_HTTP_REQUEST_ERROR, "bad CONNECT request: "+err.Error()).Write(c)
 			return
 		}
-		req.Close = false
-		req.Header = make(http.Header)
-		req.Host, _ = hostPortNoPort(req.URL) // => authority|target
+		user = proxyUser(req.Header)
+		target, _ = hostPortNoPort(req.URL) // => authority|target
 	} else {
 		// reqUrl is the raw parsed url, used for checking pac request
-		var reqUrl *url.URL
-		if req, reqUrl, err = client.newReverseRequest(requestURI); err != nil {
+		reqUrl, err := url.ParseRequestURI(requestURI)
+		if err != nil {
 			log.WithError(err).Debugln(requestURI)
-			c.Write([]byte("HTTP/1.1 400 Bad Request Reverse\r\n\r\n"))
+			newProxyError(http.StatusBadRequest, PS_HTTP_REQUEST_ERROR, "bad request uri: "+err.Error()).Write(c)
 			return
 		}
+		user = proxyUser(peekHeader(bufConn))
 
 		// check if it is a pac request
-		if reqUrl.Path == "/pac" && method == "GET" {
+		if pacPaths[reqUrl.Path] && (method == "GET" || method == "HEAD") {
 			if reqUrl.Host == "" || reqUrl.Host == c.LocalAddr().String() {
-				// pac
-				if err = client.PacTpl.Execute(c, c.LocalAddr().String()); err != nil {
-					log.WithError(err).WithField("LocalAddr", c.LocalAddr().String()).Errorln("Exec pac")
-				}
+				client.servePac(c, bufConn)
 				return
 			}
 		}
+		target, _ = hostPortNoPort(reqUrl) // => authority|target
 	}
-	//	req.RemoteAddr = client.Server // This field is ignored by the HTTP client.
-	req.URL.Scheme = "https"
-	req.URL.Host = client.ServerUrl.Host
-	req.ContentLength = -1
-	if isConnect {
-		req.Body = ioutil.NopCloser(bufConn)
-	} else {
-		reversePipeReader, reversePipeWriter := io.Pipe()
-		req.Body = ioutil.NopCloser(bufio.NewReaderSize(reversePipeReader, h2FrameSize))
-		go checkRequestEnd(reversePipeWriter, bufConn)
+	c.SetReadDeadline(time.Time{})
+	target = client.FakeIP.Unfake(target)
+	parseSpan.End()
+
+	action, rule := client.traceRoute(ctx, target)
+	var count streamCount
+	status := http.StatusOK
+	defer func() {
+		e := &AccessEntry{
+			Client: c.RemoteAddr().String(),
+			User:   user,
+			Method: method,
+			Target: target,
+			Status: status,
+			Action: action.String(),
+		}
+		if rule != nil {
+			e.Rule = rule.String()
+		}
+		t := count.Traffic()
+		e.Up, e.Down = t.Up, t.Down
+		client.logAccess(start, e)
+		span.SetAttributes(
+			attribute.String("http.method", method),
+			attribute.String("wsh.target", target),
+			attribute.Int("http.status_code", status))
+	}()
+	if action == REJECT {
+		pe := rejectError(rule)
+		status = pe.Status
+		pe.Write(c)
+		return
 	}
 
-	res, err := client.h2Transport.RoundTrip(req)
-	if err != nil {
-		log.WithError(err).Debugln("h2RoundTrip")
-		c.Write([]byte("HTTP/1.1 502 That's no street, Pete\r\n\r\n"))
+	ip := remoteIP(c.RemoteAddr().String())
+	if pe := client.Accountant.Check(user, target); pe != nil {
+		status = pe.Status
+		pe.Write(c)
 		return
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		c.Write([]byte(fmt.Sprintf("HTTP/1.1 %d Server failed to proxy\r\n\r\n", res.StatusCode)))
+	count.account(client.Accountant, client.Port, ip, user, target)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	shape := client.Shaper.Stream(ctx, client.Port, ip, target)
+	defer shape.Close()
+	defer client.track(c.RemoteAddr().String(), user, target, action, &count, func() {
+		cancel()
+		c.Close()
+	})()
+	rec := client.Capture.Record(target, isConnect)
+	defer func() { rec.Finish(client.Port, count.Traffic(), status) }()
+	var idle *idleTimer
+	var up io.Reader
+	switch {
+	case isConnect:
+		idle = newIdleTimer(client.IdleTimeout, func() {
+			log.WithField("port", client.Port).Debugln("idle timeout", target)
+			cancel()
+			c.Close()
+		})
+		defer idle.Stop()
+		up = idle.Reader(bufConn)
+	case action == DIRECT:
+		up = directRequest(bufConn)
+	default:
+		reversePipeReader, reversePipeWriter := io.Pipe()
+		up = bufio.NewReaderSize(reversePipeReader, h2FrameSize)
+		go checkRequestEnd(reversePipeWriter, bufConn)
+	}
+
+	down, pe := client.openStream(ctx, action, isConnect, target, count.UpReader(shape.UpReader(rec.Up(up))))
+	if pe != nil {
+		log.WithError(pe).Debugln("openStream", action)
+		status = pe.Status
+		pe.Write(c)
 		return
 	}
+	defer down.Close()
 
+	var body io.Reader = down
+	var sniff *statusSniffer
 	if isConnect {
 		c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	} else {
+		sniff = &statusSniffer{r: down}
+		body = sniff
 	}
 
 	//	if isConnect {
@@ -246,10 +451,18 @@ func (client *Client) connect(c net.Conn) {
 	//	} else {
 	//		_, err = io.Copy(c, io.TeeReader(res.Body, os.Stdout))
 	//	}
-	_, err = io.Copy(c, res.Body)
+	_, copySpan := startSpan(ctx, "copy")
+	_, err = io.Copy(idle.Writer(c), count.DownReader(shape.DownReader(rec.Down(body))))
 	if err != nil {
 		log.Debugln(err)
 	}
+	// stop the upload, down.Close waits for it
+	c.Close()
+	copySpan.SetAttributes(attribute.Int64("wsh.up", count.Traffic().Up), attribute.Int64("wsh.down", count.Traffic().Down))
+	endSpan(copySpan, err)
+	if sniff != nil && sniff.Status != 0 {
+		status = sniff.Status
+	}
 }
 
 func checkRequestEnd(w *io.PipeWriter, c io.Reader) {
@@ -275,6 +488,16 @@ func parseRequestLine(requestLine string) (method, requestURI, proto string, ok
 	return requestLine[:s1], requestLine[s1+1 : s2], requestLine[s2+1:], true
 }
 
+// peekHeader parses the buffered request header without consuming it.
+func peekHeader(r *bufio.Reader) http.Header {
+	peek, _ := r.Peek(r.Buffered())
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(peek)))
+	if err != nil {
+		return nil
+	}
+	return req.Header
+}
+
 // convert from net/textproto/reader.go:Reader.upcomingHeaderNewlines
 func peekRequestLine(r *bufio.Reader) ([]byte, error) {
 	r.Peek(1) // force a buffer load if empty
@@ -290,6 +513,14 @@ func peekRequestLine(r *bufio.Reader) ([]byte, error) {
 	return line, nil
 }
 
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
 // from gorilla
 func hostPortNoPort(u *url.URL) (hostPort, hostNoPort string) {
 	hostPort = u.Host
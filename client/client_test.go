@@ -0,0 +1,269 @@
+package client_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/empirefox/wsh2c/client"
+	"github.com/empirefox/wsh2c/clienttest"
+)
+
+// startClient serves a client of s on a free port, it returns the address
+// of the proxy.
+func startClient(t *testing.T, s *clienttest.Server) (*client.Client, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c := s.Client(strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+	go c.Serve(l)
+	return c, l.Addr().String()
+}
+
+// connect sends a CONNECT for target to the proxy at addr. The conn is kept
+// open, like a browser waiting for the tunnel.
+func connect(t *testing.T, addr, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("CONNECT %s: %v", target, err)
+	}
+	return conn, br, res
+}
+
+// echo serves conns that echo what they read.
+func echo(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestConnect(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	_, addr := startClient(t, s)
+
+	conn, br, res := connect(t, addr, echo(t))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", res.StatusCode)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("echo %q, want %q", b, "ping")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults clienttest.Faults
+		op     string // of the DialError, empty if the dial succeeds
+		typ    string // of the ProxyError
+	}{
+		{"drop", clienttest.Faults{Drop: true}, "tls", client.PS_TLS_PROTOCOL_ERROR},
+		{"alpn", clienttest.Faults{WrongALPN: true}, "alpn", client.PS_TLS_PROTOCOL_ERROR},
+		{"status", clienttest.Faults{Status: http.StatusBadGateway, Hosts: []string{"127.0.0.1:*"}}, "", client.PS_DESTINATION_UNAVAILABLE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := clienttest.NewServer()
+			defer s.Close()
+			s.SetFaults(tt.faults)
+			c := s.Client("0")
+
+			_, err := c.GetPac()
+			var de *client.DialError
+			if tt.op != "" && (!errors.As(err, &de) || de.Op != tt.op) {
+				t.Errorf("GetPac: %v, want a DialError of %s", err, tt.op)
+			}
+
+			_, err = c.DialTunnel(context.Background(), "tcp", echo(t))
+			var pe *client.ProxyError
+			if !errors.As(err, &pe) || pe.Type != tt.typ {
+				t.Errorf("DialTunnel: %v, want a ProxyError of %s", err, tt.typ)
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	s.Server.SetPac([]byte("pac"))
+	s.SetFaults(clienttest.Faults{Delay: 300 * time.Millisecond})
+	c := s.Client("0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.DialTunnel(ctx, "tcp", echo(t))
+	var pe *client.ProxyError
+	if !errors.As(err, &pe) || pe.Type != client.PS_CONNECTION_TIMEOUT {
+		t.Errorf("DialTunnel: %v, want a ProxyError of %s", err, client.PS_CONNECTION_TIMEOUT)
+	}
+	if d := time.Since(start); d >= 300*time.Millisecond {
+		t.Errorf("DialTunnel waited %v past its deadline", d)
+	}
+
+	start = time.Now()
+	if _, err = c.GetPac(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("GetPac took %v, under the delay", d)
+	}
+	if n := s.Accepted(); n != 1 {
+		t.Errorf("%d conns, want the dial of the canceled request reused", n)
+	}
+}
+
+func TestSharedDial(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	s.Server.SetPac([]byte("pac"))
+	s.SetFaults(clienttest.Faults{Delay: 100 * time.Millisecond})
+	c := s.Client("0")
+
+	errc := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := c.GetPac()
+			errc <- err
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := s.Accepted(); n != 1 {
+		t.Errorf("%d conns for concurrent requests, want 1", n)
+	}
+}
+
+func TestPushPacChecksServer(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	pac := []byte(`function FindProxyForURL(url, host) { return "PROXY {{.}}"; }`)
+	if err := s.Client("0").PushPac(pac); err != nil {
+		t.Fatalf("PushPac on a first conn: %v", err)
+	}
+
+	s.SetFaults(clienttest.Faults{Info: &client.ServerInfo{Version: client.PROTOCOL_VERSION, MinVersion: 1}})
+	err := s.Client("0").PushPac(pac)
+	if err == nil || !strings.Contains(err.Error(), client.FEATURE_PAC_PUSH) {
+		t.Errorf("PushPac to a server without %s: %v", client.FEATURE_PAC_PUSH, err)
+	}
+}
+
+func TestInfoRetried(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	s.Server.SetPac([]byte("pac"))
+	s.SetFaults(clienttest.Faults{Status: http.StatusServiceUnavailable, Hosts: []string{client.HOST_INFO}})
+	c := s.Client("0")
+	time.AfterFunc(300*time.Millisecond, func() { s.SetFaults(clienttest.Faults{}) })
+
+	if _, err := c.GetPac(); err != nil {
+		t.Fatalf("GetPac after a failed HOST_INFO: %v", err)
+	}
+	if n := s.Accepted(); n != 1 {
+		t.Errorf("%d conns, want HOST_INFO retried on the first", n)
+	}
+}
+
+func TestPingDropsDeadConn(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	s.Server.SetPac([]byte("pac"))
+	c := s.Client("0")
+	if _, err := c.GetPac(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.Status().Tunnels); n != 1 {
+		t.Fatalf("%d tunnels, want 1", n)
+	}
+
+	s.CloseConns()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.Status().Tunnels) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("dead conn not dropped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFetchPac(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	if err := s.Server.SetPac([]byte(`function FindProxyForURL(url, host) { return "{{.}}"; }`)); err != nil {
+		t.Fatal(err)
+	}
+	c := s.Client("0")
+
+	tpl, err := c.FetchPac(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err = tpl.Execute(&b, "PROXY 127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	if want := `function FindProxyForURL(url, host) { return "PROXY 127.0.0.1:1"; }`; b.String() != want {
+		t.Errorf("pac %q, want %q", b.String(), want)
+	}
+}
+
+func TestRejectedConnect(t *testing.T) {
+	s := clienttest.NewServer()
+	defer s.Close()
+	s.SetFaults(clienttest.Faults{Status: http.StatusBadGateway, Hosts: []string{"blocked.test:*"}})
+	_, addr := startClient(t, s)
+
+	_, _, res := connect(t, addr, "blocked.test:443")
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+	if ps := res.Header.Get("Proxy-Status"); ps == "" {
+		t.Error("no Proxy-Status")
+	}
+}
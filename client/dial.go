@@ -12,55 +12,146 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"golang.org/x/net/http2"
 )
 
-func (client *Client) DialProxyTLS(network, addr string, cfg *tls.Config) (c net.Conn, err error) {
-	if client.ServerUrl.Scheme == "tcp" {
-		c, err = client.dialTcpTLS(network, addr, cfg)
-	} else {
-		c, err = client.dialWsTLS(network, addr, cfg)
+// DialProxyTLS dials the server and checks its ServerInfo over the new conn.
+func (client *Client) DialProxyTLS(network, addr string, cfg *tls.Config) (*http2.ClientConn, error) {
+	return client.dialProxyTLS(context.Background(), network, addr, cfg)
+}
+
+// dialProxyTLS is DialProxyTLS traced as a child of the request in ctx. The
+// conn is only returned after HOST_INFO was fetched over it, an incompatible
+// server fails the dial with an *IncompatibleError.
+func (client *Client) dialProxyTLS(ctx context.Context, network, addr string, cfg *tls.Config) (cc *http2.ClientConn, err error) {
+	ctx, span := startSpan(ctx, "DialProxyTLS",
+		attribute.String("wsh.port", client.Port),
+		attribute.String("wsh.scheme", client.ServerUrl.Scheme),
+		attribute.String("wsh.server", addr))
+	defer func() { endSpan(span, err) }()
+
+	var c net.Conn
+	var closer io.Closer
+	switch {
+	case client.ReplayAddr != "":
+		var d net.Dialer
+		c, err = d.DialContext(ctx, "tcp", client.ReplayAddr)
+		closer, addr = c, client.ReplayAddr
+	case client.ServerUrl.Scheme == "tcp":
+		c, err = client.dialTcpTLS(ctx, network, addr, cfg)
+		closer = c
+	default:
+		c, closer, err = client.dialWsTLS(ctx, network, addr, cfg)
+	}
+	if err == nil && client.RecordDir != "" {
+		if rc, rerr := RecordConn(c, client.RecordDir, client.Port); rerr != nil {
+			log.WithError(rerr).Errorln("record frames")
+		} else {
+			c = rc
+		}
 	}
 
+	var info *ServerInfo
+	if err == nil {
+		info, cc, err = client.checkConn(ctx, c)
+		if err != nil {
+			closer.Close()
+		}
+	}
+	observeDial(client.Port, client.ServerUrl.Scheme, err)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"port":   client.Port,
 			"server": client.ServerUrl.Host,
 		}).Errorln(err)
+		return nil, err
 	}
-	return
+	go client.ping(cc, closer, addr, info)
+	return cc, nil
 }
 
-func (client *Client) dialTcpTLS(network, addr string, cfg *tls.Config) (net.Conn, error) {
-	cfg.ServerName = "server.h2.proxy"
-	cn, err := tls.Dial(network, addr, cfg)
+// checkConn starts h2 on c and fetches the ServerInfo over it.
+func (client *Client) checkConn(ctx context.Context, c net.Conn) (*ServerInfo, *http2.ClientConn, error) {
+	_, span := startSpan(ctx, "server info")
+	cc, err := client.h2.NewClientConn(c)
 	if err != nil {
-		return nil, err
+		endSpan(span, err)
+		return nil, nil, &DialError{Scheme: client.ServerUrl.Scheme, Op: "h2", Err: err}
 	}
-	if err := cn.Handshake(); err != nil {
-		return nil, err
+	info, err := client.retryServerInfo(ctx, cc)
+	endSpan(span, err)
+	if _, ok := err.(*IncompatibleError); ok {
+		return nil, nil, err
 	}
-	if !cfg.InsecureSkipVerify {
-		if err := cn.VerifyHostname(cfg.ServerName); err != nil {
+	if err != nil {
+		return nil, nil, &DialError{Scheme: client.ServerUrl.Scheme, Op: "info", Err: err}
+	}
+	return info, cc, nil
+}
+
+// retryServerInfo fetches the ServerInfo over a new conn, transient errors
+// are retried with backoff until infoRetryFor or the deadline of ctx.
+func (client *Client) retryServerInfo(ctx context.Context, cc *http2.ClientConn) (*ServerInfo, error) {
+	deadline := time.Now().Add(infoRetryFor)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	var backoff time.Duration
+	for {
+		info, err := client.getServerInfo(cc)
+		if _, ok := err.(*IncompatibleError); ok || err == nil {
+			return info, err
+		}
+		backoff = nextBackoff(backoff)
+		if st := cc.State(); st.Closed || st.Closing || time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		log.WithError(err).WithField("port", client.Port).Debugln("server info, retrying in", backoff)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
 			return nil, err
 		}
 	}
-	state := cn.ConnectionState()
-	if p := state.NegotiatedProtocol; p != http2.NextProtoTLS {
-		return nil, fmt.Errorf("http2: unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)
+}
+
+func (client *Client) dialTcpTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	cfg.ServerName = "server.h2.proxy"
+	_, span := startSpan(ctx, "tcp dial")
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, network, addr)
+	endSpan(span, err)
+	if err != nil {
+		return nil, &DialError{Scheme: "tcp", Op: "dial", Err: err}
 	}
-	if !state.NegotiatedProtocolIsMutual {
-		return nil, errors.New("http2: could not negotiate protocol mutually")
+	cn := tls.Client(raw, cfg)
+	if err := handshakeH2(ctx, cn, cfg); err != nil {
+		cn.Close()
+		return nil, &DialError{Scheme: "tcp", Op: err.Op, Err: err.Err}
 	}
-	go client.ping(cn, addr)
 	return cn, nil
 }
 
-func (client *Client) dialWsTLS(network, addr string, cfg *tls.Config) (net.Conn, error) {
-	ws, _, err := client.Dialer.Dial(client.ServerUrl.String()+"/p", nil)
+// dialWsTLS returns the inner tls conn and the websocket, closing the
+// websocket closes the conn at once.
+func (client *Client) dialWsTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, io.Closer, error) {
+	_, span := startSpan(ctx, "ws handshake")
+	var header http.Header
+	if client.Token != "" {
+		header = http.Header{"Authorization": {"Bearer " + client.Token}}
+	}
+	ws, res, err := client.Dialer.DialContext(ctx, client.ServerUrl.String()+"/p", header)
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		op := "dial"
+		if res != nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) {
+			op = "auth"
+		}
+		return nil, nil, &DialError{Scheme: client.ServerUrl.Scheme, Op: op, Err: err}
 	}
 	closeWs := ws
 	defer func() {
@@ -70,43 +161,80 @@ func (client *Client) dialWsTLS(network, addr string, cfg *tls.Config) (net.Conn
 	}()
 
 	pc := NewWs(ws, client.BufSize, client.PingPeriod)
+	pc.MaxMissed = client.MaxMissedPongs
+	pc.OnPong = func(rtt time.Duration) {
+		client.rtt.add(rtt)
+		pingSeconds.WithLabelValues(client.Port, "pong").Observe(rtt.Seconds())
+		r := client.rtt.report()
+		rttSeconds.WithLabelValues(client.Port, "ewma").Set(r.EWMA / 1000)
+		rttSeconds.WithLabelValues(client.Port, "jitter").Set(r.Jitter / 1000)
+	}
+	pc.OnMissedPong = func() {
+		client.rtt.miss()
+		missedPongs.WithLabelValues(client.Port).Inc()
+	}
 	u := url.URL{Host: client.ServerUrl.Host}
 	_, hostNoPort := hostPortNoPort(&u)
 	cfg.ServerName = hostNoPort
 	cn := tls.Client(pc, cfg)
 
-	if err := cn.Handshake(); err != nil {
-		return nil, err
+	if err := handshakeH2(ctx, cn, cfg); err != nil {
+		return nil, nil, &DialError{Scheme: client.ServerUrl.Scheme, Op: err.Op, Err: err.Err}
 	}
-	if !cfg.InsecureSkipVerify {
-		if err := cn.VerifyHostname(cfg.ServerName); err != nil {
-			return nil, err
-		}
+	closeWs = nil
+	client.rtt.reset()
+	go pc.Ping()
+	return cn, ws, nil
+}
+
+// handshakeH2 runs the inner tls handshake and checks ALPN.
+func handshakeH2(ctx context.Context, cn *tls.Conn, cfg *tls.Config) *DialError {
+	_, span := startSpan(ctx, "tls handshake")
+	err := cn.HandshakeContext(ctx)
+	if err == nil && !cfg.InsecureSkipVerify {
+		err = cn.VerifyHostname(cfg.ServerName)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return &DialError{Op: "tls", Err: err}
 	}
+
+	_, span = startSpan(ctx, "alpn")
 	state := cn.ConnectionState()
+	span.SetAttributes(attribute.String("tls.alpn", state.NegotiatedProtocol))
 	if p := state.NegotiatedProtocol; p != http2.NextProtoTLS {
-		return nil, fmt.Errorf("http2: unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)
+		err = fmt.Errorf("http2: unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)
+	} else if !state.NegotiatedProtocolIsMutual {
+		err = errors.New("http2: could not negotiate protocol mutually")
 	}
-	if !state.NegotiatedProtocolIsMutual {
-		return nil, errors.New("http2: could not negotiate protocol mutually")
+	endSpan(span, err)
+	if err != nil {
+		return &DialError{Op: "alpn", Err: err}
 	}
-	closeWs = nil
-	go client.ping(ws, addr)
-	return cn, nil
+	return nil
 }
 
-func (client *Client) ping(conn io.Closer, addr string) {
+// ping checks the conn with HOST_OK every PingSecond of the ServerInfo. The
+// ServerInfo is fetched again over cc after ServerInfoTTL, and retried with
+// backoff on failures without closing the conn.
+func (client *Client) ping(cc *http2.ClientConn, conn io.Closer, addr string, info *ServerInfo) {
 	log.WithField("port", client.Port).Infoln("DailTLS ok: " + addr)
-	info, err := client.getServerInfo()
-	if err != nil {
-		log.WithField("port", client.Port).Errorln("getServerInfo", err)
-		return
+	id := client.addTunnel(conn, addr)
+	period := defaultPingPeriod
+	if p := info.PingSecond * time.Second; p > 0 {
+		period = p
 	}
-
-	ticker := time.NewTicker(info.PingSecond * time.Second)
+	ticker := time.NewTicker(period)
+	infoTimer := time.NewTimer(client.ServerInfoTTL)
+	if client.ServerInfoTTL == 0 {
+		infoTimer.Stop()
+	}
+	backoff := time.Duration(0)
 	defer func() {
 		ticker.Stop()
+		infoTimer.Stop()
 		conn.Close()
+		client.removeTunnel(id)
 		log.WithField("port", client.Port).Infoln("conn closed")
 	}()
 	log.WithField("port", client.Port).Infoln("conn started")
@@ -115,14 +243,42 @@ func (client *Client) ping(conn io.Closer, addr string) {
 
 	for {
 		select {
+		case <-infoTimer.C:
+			info, err := client.getServerInfo(cc)
+			if _, ok := err.(*IncompatibleError); ok {
+				log.WithField("port", client.Port).Errorln("getServerInfo", err)
+				return
+			}
+			if err != nil {
+				backoff = nextBackoff(backoff)
+				log.WithField("port", client.Port).Warnln("getServerInfo", err, "retry in", backoff)
+				infoTimer.Reset(backoff)
+				continue
+			}
+			backoff = 0
+			if p := info.PingSecond * time.Second; p > 0 && p != period {
+				period = p
+				ticker.Reset(period)
+			}
+			if client.ServerInfoTTL > 0 {
+				infoTimer.Reset(client.ServerInfoTTL)
+			}
 		case <-ticker.C:
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			res, err := client.h2Transport.RoundTrip(req.WithContext(ctx))
+			start := time.Now()
+			res, err := cc.RoundTrip(req.WithContext(ctx))
 			if err != nil || res.StatusCode != http.StatusOK {
 				cancel()
 				return
 			}
+			res.Body.Close()
 			cancel()
+			rtt := time.Since(start)
+			pingSeconds.WithLabelValues(client.Port, "ok").Observe(rtt.Seconds())
+			if client.ServerUrl.Scheme == "tcp" {
+				client.rtt.add(rtt) // no ws pings
+			}
+			client.tunnelOK(id)
 		}
 	}
 }
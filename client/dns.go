@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsCacheSize = 4096
+	fakeIPTTL    = 1
+)
+
+// DNSServer answers local udp/tcp queries with DNS-over-HTTPS requests sent
+// through the tunnel, so queries do not leak locally.
+type DNSServer struct {
+	Addr     string      // listen address of udp and tcp
+	DoH      string      // DoH endpoint, like https://1.1.1.1/dns-query
+	Client   *Client     // tunnels the DoH requests
+	Local    []string    // domain suffixes resolved by LocalDNS
+	LocalDNS string      // like 223.5.5.5:53
+	FakeIP   *FakeIPPool // answer A queries with fake ips, nil to disable
+
+	httpClient *http.Client
+	cache      dnsCache
+}
+
+func (s *DNSServer) ListenAndServe() error {
+	s.httpClient = s.Client.HTTPClient()
+	s.cache.entries = make(map[string]*dnsCacheEntry)
+
+	errc := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: s.Addr, Net: network, Handler: s}
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+	log.WithField("addr", s.Addr).Infoln("dns server started, doh:", s.DoH)
+	return <-errc
+}
+
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	res, err := s.resolve(r)
+	if err != nil {
+		log.WithError(err).Debugln("dns", r.Question)
+		res = new(dns.Msg)
+		res.SetRcode(r, dns.RcodeServerFailure)
+	}
+	res.Id = r.Id
+	w.WriteMsg(res)
+}
+
+func (s *DNSServer) resolve(r *dns.Msg) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return nil, fmt.Errorf("only one question is supported")
+	}
+	q := r.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	if s.isLocal(name) {
+		if s.LocalDNS == "" {
+			return nil, fmt.Errorf("no local dns for %s", name)
+		}
+		res, _, err := new(dns.Client).Exchange(r, s.LocalDNS)
+		return res, err
+	}
+
+	if s.FakeIP != nil && q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		return s.fake(r, name), nil
+	}
+
+	key := q.String()
+	if res := s.cache.get(key); res != nil {
+		return res, nil
+	}
+	res, err := s.exchangeDoH(r)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.put(key, res)
+	return res, nil
+}
+
+func (s *DNSServer) isLocal(name string) bool {
+	for _, suffix := range s.Local {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fake answers A with a fake ip of name, AAAA with no records.
+func (s *DNSServer) fake(r *dns.Msg, name string) *dns.Msg {
+	res := new(dns.Msg)
+	res.SetReply(r)
+	res.RecursionAvailable = true
+	q := r.Question[0]
+	if q.Qtype == dns.TypeA {
+		res.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: fakeIPTTL},
+			A:   s.FakeIP.IP(name),
+		}}
+	}
+	return res
+}
+
+// exchangeDoH sends the query as RFC 8484 POST.
+func (s *DNSServer) exchangeDoH(r *dns.Msg) (*dns.Msg, error) {
+	q := r.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", s.DoH, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err = msg.Unpack(body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps answers for their min TTL.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+func (c *dnsCache) get(key string) *dns.Msg {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+	msg := e.msg.Copy()
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			}
+		}
+	}
+	return msg
+}
+
+func (c *dnsCache) put(key string, msg *dns.Msg) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+	ttl := uint32(60) // negative answers without SOA
+	first := true
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range rrs {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= dnsCacheSize {
+			c.entries = make(map[string]*dnsCacheEntry)
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// FakeIPPool maps domains to ips of a private range, used with transparent
+// proxying so the tunnel gets the domain back.
+type FakeIPPool struct {
+	mu       sync.Mutex
+	base     uint32
+	size     uint32
+	next     uint32
+	byIP     map[uint32]string
+	byDomain map[string]uint32
+}
+
+// NewFakeIPPool uses cidr like 198.18.0.0/15.
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipnet.IP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("fake ip range MUST be ipv4: %s", cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	if size < 4 {
+		return nil, fmt.Errorf("fake ip range too small: %s", cidr)
+	}
+	return &FakeIPPool{
+		base:     binary.BigEndian.Uint32(ip4),
+		size:     size,
+		next:     1, // skip network address
+		byIP:     make(map[uint32]string),
+		byDomain: make(map[string]uint32),
+	}, nil
+}
+
+// IP returns the fake ip of domain, the oldest mapping is reused when full.
+func (p *FakeIPPool) IP(domain string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, ok := p.byDomain[domain]
+	if !ok {
+		n = p.base + p.next
+		if old, ok := p.byIP[n]; ok {
+			delete(p.byDomain, old)
+		}
+		p.byIP[n] = domain
+		p.byDomain[domain] = n
+		if p.next++; p.next >= p.size-1 { // skip broadcast address
+			p.next = 1
+		}
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// Domain returns the domain of a fake ip.
+func (p *FakeIPPool) Domain(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if p == nil || ip4 == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domain, ok := p.byIP[binary.BigEndian.Uint32(ip4)]
+	return domain, ok
+}
+
+// Unfake replaces a fake ip in host:port with its domain, a nil pool keeps
+// the target.
+func (p *FakeIPPool) Unfake(target string) string {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target
+	}
+	if domain, ok := p.Domain(net.ParseIP(host)); ok {
+		return net.JoinHostPort(domain, port)
+	}
+	return target
+}
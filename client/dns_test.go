@@ -0,0 +1,115 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func dnsAnswer(t *testing.T, rcode int, rrs ...string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Rcode = rcode
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return msg
+}
+
+func TestDNSCache(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		cached bool
+	}{
+		{"answer", dnsAnswer(t, dns.RcodeSuccess, "example.com. 300 IN A 1.2.3.4"), true},
+		{"nxdomain", dnsAnswer(t, dns.RcodeNameError), true},
+		{"servfail", dnsAnswer(t, dns.RcodeServerFailure), false},
+		{"zero ttl", dnsAnswer(t, dns.RcodeSuccess, "example.com. 0 IN A 1.2.3.4"), false},
+	}
+	for _, tt := range tests {
+		c := &dnsCache{entries: make(map[string]*dnsCacheEntry)}
+		c.put(tt.name, tt.msg)
+		if got := c.get(tt.name) != nil; got != tt.cached {
+			t.Errorf("%s: cached %v, want %v", tt.name, got, tt.cached)
+		}
+	}
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	c := &dnsCache{entries: make(map[string]*dnsCacheEntry)}
+	c.put("a", dnsAnswer(t, dns.RcodeSuccess, "example.com. 300 IN A 1.2.3.4", "example.com. 60 IN A 1.2.3.5"))
+	e := c.entries["a"]
+	if d := time.Until(e.expires); d > 60*time.Second || d < 59*time.Second {
+		t.Fatalf("expires in %v, want the min ttl", d)
+	}
+
+	e.stored = e.stored.Add(-10 * time.Second)
+	msg := c.get("a")
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 290 {
+		t.Errorf("ttl %d after 10s, want 290", ttl)
+	}
+	if ttl := e.msg.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("get changed the cached ttl to %d", ttl)
+	}
+
+	e.expires = time.Now().Add(-time.Second)
+	if c.get("a") != nil {
+		t.Error("got an expired answer")
+	}
+}
+
+func TestFakeIPPool(t *testing.T) {
+	for _, cidr := range []string{"fd00::/64", "10.0.0.0/31", "bad"} {
+		if _, err := NewFakeIPPool(cidr); err == nil {
+			t.Errorf("NewFakeIPPool(%s) accepted", cidr)
+		}
+	}
+
+	p, err := NewFakeIPPool("198.18.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.IP("a.example.com")
+	if !a.Equal(net.IPv4(198, 18, 0, 1)) {
+		t.Errorf("first ip %s, want 198.18.0.1", a)
+	}
+	if b := p.IP("a.example.com"); !b.Equal(a) {
+		t.Errorf("same domain got %s and %s", a, b)
+	}
+	if got := p.Unfake(net.JoinHostPort(a.String(), "443")); got != "a.example.com:443" {
+		t.Errorf("Unfake = %s", got)
+	}
+	if got := p.Unfake("1.1.1.1:53"); got != "1.1.1.1:53" {
+		t.Errorf("Unfake of a real ip = %s", got)
+	}
+
+	// 6 usable ips without the network and broadcast addresses
+	for i := 0; i < 6; i++ {
+		ip := p.IP(strconv.Itoa(i) + ".example.com")
+		if ip.Equal(net.IPv4(198, 18, 0, 0)) || ip.Equal(net.IPv4(198, 18, 0, 7)) {
+			t.Fatalf("gave out %s", ip)
+		}
+	}
+	if _, ok := p.Domain(a); !ok {
+		t.Fatal("no domain of a reused ip")
+	}
+	if d, _ := p.Domain(a); d == "a.example.com" {
+		t.Error("oldest mapping not reused")
+	}
+	if _, ok := p.byDomain["a.example.com"]; ok {
+		t.Error("reused domain still mapped")
+	}
+
+	var nilPool *FakeIPPool
+	if got := nilPool.Unfake("198.18.0.1:80"); got != "198.18.0.1:80" {
+		t.Errorf("nil pool Unfake = %s", got)
+	}
+}
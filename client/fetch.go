@@ -1,41 +1,16 @@
 package client
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"text/template"
-	"time"
 )
 
-type ServerInfo struct {
-	PingSecond time.Duration
-}
-
-func (client *Client) getServerInfo() (*ServerInfo, error) {
-	client.muServerInfo.Lock()
-	defer client.muServerInfo.Unlock()
-
-	if client.serverInfo == nil {
-		body, err := client.fetch("GET", HOST_INFO)
-		if err != nil {
-			return nil, err
-		}
-
-		var info ServerInfo
-		err = json.Unmarshal(body, &info)
-		if err != nil {
-			return nil, err
-		}
-
-		client.serverInfo = &info
-	}
-
-	return client.serverInfo, nil
-}
-
 func (client *Client) FetchPac(update bool) (*template.Template, error) {
 	host := HOST_PAC
 	if update {
@@ -49,9 +24,44 @@ func (client *Client) FetchPac(update bool) (*template.Template, error) {
 	return template.New("pac").Parse(string(body))
 }
 
+// GetPac returns the raw pac template of the server.
+func (client *Client) GetPac() ([]byte, error) {
+	return client.fetch("GET", HOST_PAC)
+}
+
+// PushPac uploads a pac template to the server.
+func (client *Client) PushPac(body []byte) error {
+	ok, err := client.supports(context.Background(), FEATURE_PAC_PUSH)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("push pac: the server does not support %s", FEATURE_PAC_PUSH)
+	}
+	req := client.innerRequest("PUT", HOST_PAC)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	res, err := client.h2Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("push pac: %s %s", res.Status, msg)
+	}
+	return nil
+}
+
 func (client *Client) fetch(method, host string) ([]byte, error) {
+	return client.fetchOn(client.h2Transport, method, host)
+}
+
+// fetchOn is fetch over rt, like a single conn.
+func (client *Client) fetchOn(rt http.RoundTripper, method, host string) ([]byte, error) {
 	req := client.innerRequest(method, host)
-	res, err := client.h2Transport.RoundTrip(req)
+	res, err := rt.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +83,7 @@ func (client *Client) innerRequest(method, host string) *http.Request {
 			Path:   "/",
 		},
 		Host:       host,
+		Header:     make(http.Header),
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
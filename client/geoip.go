@@ -0,0 +1,82 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP looks up countries in a local MaxMind country database (.mmdb).
+type GeoIP struct {
+	File string
+
+	mu sync.RWMutex
+	db *maxminddb.Reader
+}
+
+func OpenGeoIP(file string) (*GeoIP, error) {
+	g := &GeoIP{File: file}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload reopens File, the old database is kept on error.
+func (g *GeoIP) Reload() error {
+	db, err := maxminddb.Open(g.File)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	old := g.db
+	g.db = db
+	g.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	log.WithField("file", g.File).Infoln("GeoIP loaded", db.Metadata.DatabaseType)
+	return nil
+}
+
+// Country returns the ISO country code of ip, empty if not found.
+func (g *GeoIP) Country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if err := g.db.Lookup(ip, &record); err != nil {
+		log.WithError(err).Debugln("GeoIP lookup", ip)
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// GEOIP,CN,DIRECT matches when any ip of the target is in the country.
+func parseGeoIP(rule *Rule) error {
+	country := strings.ToUpper(rule.Value)
+	rule.match = func(r *Router, t *routeTarget) bool {
+		if r.GeoIP == nil {
+			return false
+		}
+		for _, ip := range rule.ips(t) {
+			if r.GeoIP.Country(ip) == country {
+				return true
+			}
+		}
+		return false
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/http2"
+)
+
+const h2PrefaceLine = "PRI * HTTP/2.0\r\n"
+
+// bufferedConn reads through the bufio.Reader that peeked the request line.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// isTLSHandshake peeks the first byte for a tls handshake record.
+func isTLSHandshake(r *bufio.Reader) bool {
+	b, err := r.Peek(1)
+	return err == nil && b[0] == 0x16
+}
+
+// serveH2 serves HTTP/2 from a local client, every stream is mapped onto a
+// stream of the upstream h2Transport and takes a slot of MaxConns.
+func (client *Client) serveH2(c net.Conn) {
+	h2s := &http2.Server{MaxConcurrentStreams: uint32(client.MaxConns)}
+	h2s.ServeConn(c, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(client.serveH2Stream),
+	})
+}
+
+func (client *Client) serveH2Stream(rw http.ResponseWriter, r *http.Request) {
+	if pe := client.acquire(); pe != nil {
+		h2Error(rw, pe)
+		return
+	}
+	defer client.release()
+	start := time.Now()
+	ctx, span := startSpan(r.Context(), "h2 stream",
+		attribute.String("wsh.port", client.Port),
+		attribute.String("net.peer.addr", r.RemoteAddr),
+		attribute.String("http.method", r.Method))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	isConnect := r.Method == "CONNECT" && r.Header.Get(":protocol") == ""
+	target := r.Host
+	if !isConnect {
+		target = reverseTarget(r)
+	}
+	target = client.FakeIP.Unfake(target)
+	action, rule := client.traceRoute(ctx, target)
+
+	w := &statusWriter{ResponseWriter: rw}
+	count := new(streamCount)
+	defer func() {
+		e := &AccessEntry{
+			Client: r.RemoteAddr,
+			User:   proxyUser(r.Header),
+			Method: r.Method,
+			Target: target,
+			Status: w.status,
+			Action: action.String(),
+		}
+		if rule != nil {
+			e.Rule = rule.String()
+		}
+		t := count.Traffic()
+		e.Up, e.Down = t.Up, t.Down
+		client.logAccess(start, e)
+		span.SetAttributes(attribute.String("wsh.target", target), attribute.Int("http.status_code", w.status))
+	}()
+	if action == REJECT {
+		h2Error(w, rejectError(rule))
+		return
+	}
+
+	switch {
+	case isConnect:
+		client.serveH2Connect(w, r, action, count)
+	case r.Method == "CONNECT":
+		// extended CONNECT (RFC 8441) is not enabled by the http2.Server
+		h2Error(w, newProxyError(http.StatusNotImplemented, PS_HTTP_REQUEST_ERROR, "unsupported protocol: "+r.Header.Get(":protocol")))
+	default:
+		client.serveH2Reverse(w, r, action, target, count)
+	}
+}
+
+func (client *Client) serveH2Connect(w http.ResponseWriter, r *http.Request, action Action, count *streamCount) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	idle := newIdleTimer(client.IdleTimeout, cancel)
+	defer idle.Stop()
+
+	done, pe := client.account(r, r.Host, action, count, cancel)
+	if pe != nil {
+		h2Error(w, pe)
+		return
+	}
+	defer done()
+
+	shape := client.Shaper.Stream(ctx, client.Port, remoteIP(r.RemoteAddr), r.Host)
+	defer shape.Close()
+	up := count.UpReader(shape.UpReader(idle.Reader(r.Body)))
+	down, pe := client.openStream(ctx, action, true, r.Host, up)
+	if pe != nil {
+		log.WithError(pe).Debugln("openStream", action)
+		h2Error(w, pe)
+		return
+	}
+	defer down.Close()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	_, copySpan := startSpan(ctx, "copy")
+	_, err := io.Copy(idle.Writer(flushWriter{w}), count.DownReader(shape.DownReader(down)))
+	if err != nil {
+		log.Debugln(err)
+	}
+	endSpan(copySpan, err)
+}
+
+// serveH2Reverse replays the request as HTTP/1.1 over the reverse path.
+func (client *Client) serveH2Reverse(w http.ResponseWriter, r *http.Request, action Action, target string, count *streamCount) {
+	r.Header.Set("Connection", "close")
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	done, pe := client.account(r, target, action, count, cancel)
+	if pe != nil {
+		h2Error(w, pe)
+		return
+	}
+	defer done()
+
+	shape := client.Shaper.Stream(ctx, client.Port, remoteIP(r.RemoteAddr), target)
+	defer shape.Close()
+	rec := client.Capture.Record(target, false)
+	var status int
+	defer func() { rec.Finish(client.Port, count.Traffic(), status) }()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.Write(pw))
+	}()
+
+	down, pe := client.openStream(ctx, action, false, target, count.UpReader(shape.UpReader(rec.Up(pr))))
+	if pe != nil {
+		log.WithError(pe).Debugln("openStream", action)
+		status = pe.Status
+		h2Error(w, pe)
+		return
+	}
+	defer down.Close()
+
+	h1res, err := http.ReadResponse(bufio.NewReader(count.DownReader(shape.DownReader(rec.Down(down)))), r)
+	if err != nil {
+		status = http.StatusBadGateway
+		h2Error(w, newProxyError(http.StatusBadGateway, PS_PROXY_INTERNAL_ERROR, err.Error()))
+		return
+	}
+	defer h1res.Body.Close()
+	status = h1res.StatusCode
+	copyHeader(w.Header(), h1res.Header)
+	w.WriteHeader(h1res.StatusCode)
+	_, copySpan := startSpan(ctx, "copy")
+	if _, err = io.Copy(flushWriter{w}, h1res.Body); err != nil {
+		log.Debugln(err)
+	}
+	endSpan(copySpan, err)
+}
+
+// account checks quotas of the local h2 request, counts its traffic and
+// tracks the stream until done. cancel aborts the stream.
+func (client *Client) account(r *http.Request, target string, action Action, count *streamCount, cancel func()) (func(), *ProxyError) {
+	user := proxyUser(r.Header)
+	if pe := client.Accountant.Check(user, target); pe != nil {
+		return nil, pe
+	}
+	count.account(client.Accountant, client.Port, remoteIP(r.RemoteAddr), user, target)
+	return client.track(r.RemoteAddr, user, target, action, count, cancel), nil
+}
+
+// roundTripReverse posts the raw HTTP/1.1 stream in body to target. The
+// request is replayed to proxy server, the url is pointing to proxy server.
+func (client *Client) roundTripReverse(ctx context.Context, target string, body io.Reader) (*http.Response, *ProxyError) {
+	reverse, err := client.supports(ctx, FEATURE_REVERSE)
+	if err != nil {
+		return nil, errorFromRoundTrip(err)
+	}
+	var req *http.Request
+	if reverse {
+		rr := client.h2ReverseReq
+		u := *rr.URL
+		rr.URL = &u
+		rr.Header = make(http.Header)
+		rr.Host = target
+		rr.ContentLength = -1
+		req = &rr
+	} else {
+		// the raw request goes through a tunnel to target instead
+		req = client.newConnectRequest(target)
+	}
+	req.Body = ioutil.NopCloser(body)
+
+	res, err := client.h2Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, errorFromRoundTrip(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errorFromStatus(res.StatusCode)
+	}
+	return res, nil
+}
+
+// statusWriter keeps the status code for the access log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func h2Error(w http.ResponseWriter, pe *ProxyError) {
+	w.Header().Set("Proxy-Status", pe.proxyStatus())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(pe.Status)
+	fmt.Fprintf(w, "%d %s\nwsh: %s\n%s\n", pe.Status, http.StatusText(pe.Status), pe.Type, pe.Details)
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.w.(http.Flusher).Flush()
+	return n, err
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		switch k {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Proxy-Connection":
+			continue
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// reverseTarget is the host:port a local h2 request is replayed to, the
+// reverse path only carries plain http.
+func reverseTarget(r *http.Request) string {
+	hostPort, _ := hostPortNoPort(&url.URL{Scheme: "http", Host: r.Host})
+	return hostPort
+}
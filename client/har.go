@@ -0,0 +1,513 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	harHeaderLimit = 64 << 10
+	harQueue       = 256 // entries waiting to be written, more are dropped
+
+	harHead = `{"log": {"version": "1.2", "creator": {"name": "wsh", "version": "1"}, "entries": [`
+	harTail = "\n]}}\n"
+
+	redacted = "[redacted]"
+)
+
+// credentialHeaders are redacted unless Capture.KeepCredentials.
+var credentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// Capture records plain HTTP of the reverse path into HAR 1.2 files, CONNECT
+// tunnels are recorded without content. Entries are appended to the file by
+// a background writer, the file is valid HAR after each entry.
+type Capture struct {
+	Dir             string
+	Hosts           []string // path.Match patterns of target hosts, all if empty
+	MaxBody         int      // bytes kept of each body
+	MaxEntries      int      // entries of a file before rotating
+	MaxFiles        int      // files kept in Dir, 0 keeps all
+	KeepCredentials bool     // record credential headers and cookies unredacted
+
+	mu      sync.Mutex
+	entries chan harEntry // nil before the first entry
+	done    chan struct{}
+	closed  bool
+
+	// used by the writer only
+	file    *os.File
+	offset  int64 // of the tail
+	written int   // entries in file
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Record starts recording a connection to target, nil if target is not
+// captured. All methods of a nil recorder do nothing.
+func (c *Capture) Record(target string, isConnect bool) *HarRecorder {
+	if c == nil || !c.match(target) {
+		return nil
+	}
+	limit := c.MaxBody + harHeaderLimit
+	if isConnect {
+		limit = 0
+	}
+	return &HarRecorder{
+		capture:   c,
+		target:    target,
+		isConnect: isConnect,
+		start:     time.Now(),
+		up:        limitedBuffer{limit: limit},
+		down:      limitedBuffer{limit: limit},
+	}
+}
+
+func (c *Capture) match(target string) bool {
+	if len(c.Hosts) == 0 {
+		return true
+	}
+	host := hostNoPort(target)
+	for _, pattern := range c.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// add queues the entry for the writer, it is dropped if the writer is too
+// far behind.
+func (c *Capture) add(e harEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(chan harEntry, harQueue)
+		c.done = make(chan struct{})
+		go c.writeLoop()
+	}
+	select {
+	case c.entries <- e:
+	default:
+		log.Warnln("har capture: writer is behind, entry dropped", e.Request.URL)
+	}
+}
+
+// Close writes the queued entries and closes the file.
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	entries := c.entries
+	c.closed = true
+	c.mu.Unlock()
+	if entries == nil {
+		return nil
+	}
+	close(entries)
+	<-c.done
+	return nil
+}
+
+func (c *Capture) writeLoop() {
+	defer close(c.done)
+	for e := range c.entries {
+		if err := c.write(e); err != nil {
+			log.WithError(err).Errorln("har capture")
+		}
+	}
+	if c.file != nil {
+		c.file.Close()
+	}
+}
+
+// write appends the entry to the current file, a new file is started after
+// MaxEntries. The entry overwrites the tail, which is written again after it.
+func (c *Capture) write(e harEntry) error {
+	if c.file == nil || (c.MaxEntries > 0 && c.written >= c.MaxEntries) {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(&e, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n    "
+	if c.written == 0 {
+		sep = "\n    "
+	}
+	b = append(append([]byte(sep), b...), harTail...)
+	if _, err = c.file.WriteAt(b, c.offset); err != nil {
+		return err
+	}
+	c.offset += int64(len(b) - len(harTail))
+	c.written++
+	return nil
+}
+
+func (c *Capture) rotate() error {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return err
+	}
+	c.removeOld()
+	name := filepath.Join(c.Dir, "wsh-"+time.Now().Format("20060102-150405.000")+".har")
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(harHead + harTail); err != nil {
+		f.Close()
+		return err
+	}
+	c.file, c.offset, c.written = f, int64(len(harHead)), 0
+	return nil
+}
+
+// removeOld keeps the newest MaxFiles files including the current one.
+func (c *Capture) removeOld() {
+	if c.MaxFiles <= 0 {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(c.Dir, "wsh-*.har"))
+	sort.Strings(files)
+	for len(files) >= c.MaxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+// HarRecorder records one connection.
+type HarRecorder struct {
+	capture   *Capture
+	target    string
+	isConnect bool
+	start     time.Time
+	lastUp    time.Time
+	firstDown time.Time
+	up        limitedBuffer
+	down      limitedBuffer
+	mu        sync.Mutex
+}
+
+// Up records the data from the local client.
+func (r *HarRecorder) Up(rd io.Reader) io.Reader {
+	if r == nil {
+		return rd
+	}
+	return &recordReader{rd, func(p []byte) {
+		r.mu.Lock()
+		if r.firstDown.IsZero() {
+			r.lastUp = time.Now()
+		}
+		r.mu.Unlock()
+		r.up.Write(p)
+	}}
+}
+
+// Down records the data to the local client.
+func (r *HarRecorder) Down(rd io.Reader) io.Reader {
+	if r == nil {
+		return rd
+	}
+	return &recordReader{rd, func(p []byte) {
+		r.mu.Lock()
+		if r.firstDown.IsZero() {
+			r.firstDown = time.Now()
+		}
+		r.mu.Unlock()
+		r.down.Write(p)
+	}}
+}
+
+// Finish writes the entry, status is sent to the local client.
+func (r *HarRecorder) Finish(port string, t Traffic, status int) {
+	if r == nil {
+		return
+	}
+	end := time.Now()
+	r.mu.Lock()
+	lastUp, firstDown := r.lastUp, r.firstDown
+	r.mu.Unlock()
+	if lastUp.IsZero() {
+		lastUp = r.start
+	}
+	if firstDown.IsZero() {
+		firstDown = end
+	}
+
+	e := harEntry{
+		StartedDateTime: r.start.Format(time.RFC3339Nano),
+		Time:            ms(float64(end.Sub(r.start))),
+		Timings: harTimings{
+			Send:    ms(float64(lastUp.Sub(r.start))),
+			Wait:    ms(float64(firstDown.Sub(lastUp))),
+			Receive: ms(float64(end.Sub(firstDown))),
+		},
+		Comment: fmt.Sprintf("port %s, up %d bytes, down %d bytes", port, t.Up, t.Down),
+	}
+	if r.isConnect {
+		e.Request = harRequest{
+			Method:      "CONNECT",
+			URL:         "https://" + r.target,
+			HTTPVersion: "HTTP/1.1",
+			HeadersSize: -1,
+			BodySize:    t.Up,
+		}
+		e.Response = harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: "HTTP/1.1",
+			HeadersSize: -1,
+			BodySize:    t.Down,
+		}
+		e.Comment = "tunnel, content not recorded, " + e.Comment
+	} else {
+		r.fillRequest(&e.Request)
+		r.fillResponse(&e.Response, status)
+	}
+	nonNil(&e.Request.Cookies, &e.Request.Headers, &e.Request.QueryString, &e.Response.Cookies, &e.Response.Headers)
+	r.capture.add(e)
+}
+
+func (r *HarRecorder) fillRequest(hr *harRequest) {
+	hr.HeadersSize = -1
+	hr.BodySize = -1
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(r.up.Bytes())))
+	if err != nil {
+		hr.Method = "-"
+		hr.URL = "http://" + r.target + "/"
+		hr.HTTPVersion = "HTTP/1.1"
+		return
+	}
+	defer req.Body.Close()
+	hr.Method = req.Method
+	hr.URL = req.URL.String()
+	if req.URL.Host == "" {
+		hr.URL = "http://" + req.Host + req.URL.RequestURI()
+	}
+	hr.HTTPVersion = req.Proto
+	hr.Headers = r.harHeaders(req.Header)
+	for _, c := range req.Cookies() {
+		hr.Cookies = append(hr.Cookies, harNameValue{c.Name, r.cookieValue(c.Value)})
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			hr.QueryString = append(hr.QueryString, harNameValue{k, v})
+		}
+	}
+	body, truncated := r.readBody(req.Body)
+	hr.BodySize = bodySize(req.ContentLength, body, truncated)
+	if len(body) > 0 {
+		hr.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: string(body)}
+		if truncated {
+			hr.PostData.Comment = "truncated"
+		}
+	}
+}
+
+func (r *HarRecorder) fillResponse(hr *harResponse, status int) {
+	hr.HeadersSize = -1
+	hr.BodySize = -1
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(r.down.Bytes())), nil)
+	if err != nil {
+		hr.Status = status
+		hr.StatusText = http.StatusText(status)
+		hr.HTTPVersion = "HTTP/1.1"
+		return
+	}
+	defer res.Body.Close()
+	hr.Status = res.StatusCode
+	hr.StatusText = http.StatusText(res.StatusCode)
+	hr.HTTPVersion = res.Proto
+	hr.Headers = r.harHeaders(res.Header)
+	hr.RedirectURL = res.Header.Get("Location")
+	for _, c := range res.Cookies() {
+		hr.Cookies = append(hr.Cookies, harNameValue{c.Name, r.cookieValue(c.Value)})
+	}
+	body, truncated := r.readBody(res.Body)
+	hr.BodySize = bodySize(res.ContentLength, body, truncated)
+	hr.Content = harContent{Size: hr.BodySize, MimeType: res.Header.Get("Content-Type")}
+	if utf8.Valid(body) {
+		hr.Content.Text = string(body)
+	} else {
+		hr.Content.Text = base64.StdEncoding.EncodeToString(body)
+		hr.Content.Encoding = "base64"
+	}
+	if truncated {
+		hr.Content.Comment = "truncated"
+	}
+}
+
+// readBody reads at most MaxBody bytes of a recorded body.
+func (r *HarRecorder) readBody(body io.Reader) ([]byte, bool) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, int64(r.capture.MaxBody)))
+	if err != nil {
+		return b, true
+	}
+	n, _ := body.Read(make([]byte, 1))
+	return b, n > 0
+}
+
+// bodySize is the full size of a body if known, -1 if truncated without
+// Content-Length.
+func bodySize(contentLength int64, body []byte, truncated bool) int64 {
+	switch {
+	case !truncated:
+		return int64(len(body))
+	case contentLength >= 0:
+		return contentLength
+	}
+	return -1
+}
+
+// harHeaders lists h, credentials are redacted unless KeepCredentials.
+func (r *HarRecorder) harHeaders(h http.Header) []harNameValue {
+	var nvs []harNameValue
+	for k, vs := range h {
+		for _, v := range vs {
+			if credentialHeaders[k] && !r.capture.KeepCredentials {
+				v = redacted
+			}
+			nvs = append(nvs, harNameValue{k, v})
+		}
+	}
+	sort.Slice(nvs, func(i, j int) bool { return strings.ToLower(nvs[i].Name) < strings.ToLower(nvs[j].Name) })
+	return nvs
+}
+
+func (r *HarRecorder) cookieValue(v string) string {
+	if r.capture.KeepCredentials {
+		return v
+	}
+	return redacted
+}
+
+// nonNil makes empty lists [] instead of null, HAR requires them.
+func nonNil(lists ...*[]harNameValue) {
+	for _, l := range lists {
+		if *l == nil {
+			*l = []harNameValue{}
+		}
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written.
+type limitedBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := b.limit - b.buf.Len(); n > 0 {
+		if len(p) > n {
+			p = p[:n]
+		}
+		b.buf.Write(p)
+	}
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+type recordReader struct {
+	r      io.Reader
+	record func(p []byte)
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.record(p[:n])
+	}
+	return n, err
+}
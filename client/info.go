@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// PROTOCOL_VERSION is the wsh protocol of this client, servers before
+	// versioning speak version 1.
+	PROTOCOL_VERSION   = 2
+	MIN_SERVER_VERSION = 1
+
+	FEATURE_REVERSE  = "reverse"  // plain http through /r
+	FEATURE_PAC_PUSH = "pac_push" // PUT of HOST_PAC
+
+	// FEATURE_UDP and FEATURE_COMPRESSION are reserved by PROTOCOL.md, no
+	// server advertises them yet and the client never uses them.
+	FEATURE_UDP         = "udp"         // udp associate streams
+	FEATURE_COMPRESSION = "compression" // compressed stream bodies
+
+	// refuseFor fails requests fast after an incompatible server was found,
+	// a new conn checks again after it.
+	refuseFor = 30 * time.Second
+
+	// defaultPingPeriod is used until the ServerInfo is fetched.
+	defaultPingPeriod = 30 * time.Second
+	minInfoBackoff    = time.Second
+	maxInfoBackoff    = time.Minute
+
+	// infoRetryFor bounds the retries of HOST_INFO over a new conn.
+	infoRetryFor = 10 * time.Second
+)
+
+// legacyFeatures are implied by servers before versioning.
+var legacyFeatures = []string{FEATURE_REVERSE, FEATURE_PAC_PUSH}
+
+// ServerInfo is the capability document of HOST_INFO.
+type ServerInfo struct {
+	Version    int // protocol version, 0 for servers before versioning
+	MinVersion int // oldest client protocol the server supports
+	PingSecond time.Duration
+	Features   []string
+	MaxStreams uint32 // concurrent streams per conn, 0 if unknown
+	PacVersion string // changes with the pac, empty if unknown
+}
+
+// normalize fills the implied fields of servers before versioning.
+func (info *ServerInfo) normalize() {
+	if info.Version == 0 {
+		info.Version = 1
+		info.Features = legacyFeatures
+	}
+}
+
+// Supports reports whether the server advertised feature.
+func (info *ServerInfo) Supports(feature string) bool {
+	for _, f := range info.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an *IncompatibleError if the server can not be used.
+func (info *ServerInfo) Check() error {
+	if info.Version < MIN_SERVER_VERSION || info.MinVersion > PROTOCOL_VERSION {
+		return &IncompatibleError{Server: info.Version, MinClient: info.MinVersion}
+	}
+	return nil
+}
+
+// IncompatibleError refuses a server of an unsupported protocol version.
+type IncompatibleError struct {
+	Server    int // protocol version of the server
+	MinClient int // oldest client protocol the server supports
+}
+
+func (e *IncompatibleError) Error() string {
+	if e.Server < MIN_SERVER_VERSION {
+		return fmt.Sprintf("incompatible server: protocol version %d, this client requires %d or later", e.Server, MIN_SERVER_VERSION)
+	}
+	return fmt.Sprintf("incompatible server: requires clients of protocol version %d or later, this client is %d, please upgrade wsh", e.MinClient, PROTOCOL_VERSION)
+}
+
+// serverInfoState is the last ServerInfo and the refusal of an
+// incompatible server.
+type serverInfoState struct {
+	mu        sync.Mutex
+	info      *ServerInfo
+	refused   error
+	refusedAt time.Time
+}
+
+// getServerInfo fetches and checks the ServerInfo over cc, it is called for
+// each new conn and after ServerInfoTTL. An incompatible server is refused
+// for a while. OnServerInfo is called if the ServerInfo changed.
+func (client *Client) getServerInfo(cc http.RoundTripper) (*ServerInfo, error) {
+	body, err := client.fetchOn(cc, "GET", HOST_INFO)
+	if err != nil {
+		return nil, err
+	}
+	var info ServerInfo
+	if err = json.Unmarshal(body, &info); err != nil {
+		return nil, err
+	}
+	info.normalize()
+
+	s := &client.serverInfo
+	s.mu.Lock()
+	old := s.info
+	s.info = &info
+	err = info.Check()
+	if err != nil {
+		s.refused, s.refusedAt = err, time.Now()
+	} else {
+		s.refused = nil
+	}
+	s.mu.Unlock()
+
+	if old == nil || !reflect.DeepEqual(*old, info) {
+		if old != nil {
+			log.WithField("port", client.Port).Infof("server info changed: %+v", info)
+		}
+		if client.OnServerInfo != nil {
+			client.OnServerInfo(old, &info)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// nextBackoff doubles the backoff of ServerInfo retries.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d < minInfoBackoff {
+		d = minInfoBackoff
+	}
+	if d > maxInfoBackoff {
+		d = maxInfoBackoff
+	}
+	return d
+}
+
+// ServerInfo returns the last fetched ServerInfo, nil before the first conn.
+func (client *Client) ServerInfo() *ServerInfo {
+	client.serverInfo.mu.Lock()
+	defer client.serverInfo.mu.Unlock()
+	return client.serverInfo.info
+}
+
+// checkedServerInfo returns the ServerInfo checked over a conn, before the
+// first conn it dials one by sending HOST_OK.
+func (client *Client) checkedServerInfo(ctx context.Context) (*ServerInfo, error) {
+	if info := client.ServerInfo(); info != nil && info.Check() == nil {
+		return info, nil
+	}
+	req := client.innerRequest("HEAD", HOST_OK)
+	res, err := client.h2Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	info := client.ServerInfo()
+	if info == nil {
+		return nil, fmt.Errorf("no server info after %s", HOST_OK)
+	}
+	return info, info.Check()
+}
+
+// supports reports whether the server advertised feature, it dials first
+// if no conn checked the server yet.
+func (client *Client) supports(ctx context.Context, feature string) (bool, error) {
+	info, err := client.checkedServerInfo(ctx)
+	if err != nil {
+		return false, err
+	}
+	return info.Supports(feature), nil
+}
+
+// refusedError fails requests to an incompatible server.
+func (client *Client) refusedError() *ProxyError {
+	s := &client.serverInfo
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refused == nil || time.Since(s.refusedAt) > refuseFor {
+		return nil
+	}
+	return newProxyError(http.StatusBadGateway, PS_PROXY_INTERNAL_ERROR, s.refused.Error())
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// acquire waits QueueTimeout for a free slot of the listener. A slot is held
+// by each HTTP/1 conn and by each stream of a local h2 conn, so one h2 conn
+// can not open more streams to the server than MaxConns.
+func (client *Client) acquire() *ProxyError {
+	if client.connSem == nil {
+		return nil
+	}
+	select {
+	case client.connSem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if client.QueueTimeout > 0 {
+		timer := time.NewTimer(client.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case client.connSem <- struct{}{}:
+			return nil
+		case <-timer.C:
+		}
+	}
+
+	log.WithField("port", client.Port).Warnln("connection limit reached", client.MaxConns)
+	return newProxyError(http.StatusServiceUnavailable, PS_CONNECTION_LIMIT_REACHED, "too many connections to this listener")
+}
+
+func (client *Client) release() {
+	if client.connSem != nil {
+		<-client.connSem
+	}
+}
+
+// idleTimer calls onIdle when no data moved in either direction for d.
+type idleTimer struct {
+	t *time.Timer
+	d time.Duration
+}
+
+func newIdleTimer(d time.Duration, onIdle func()) *idleTimer {
+	if d <= 0 {
+		return nil
+	}
+	return &idleTimer{t: time.AfterFunc(d, onIdle), d: d}
+}
+
+func (it *idleTimer) touch() {
+	if it != nil {
+		it.t.Reset(it.d)
+	}
+}
+
+func (it *idleTimer) Stop() {
+	if it != nil {
+		it.t.Stop()
+	}
+}
+
+func (it *idleTimer) Reader(r io.Reader) io.Reader {
+	if it == nil {
+		return r
+	}
+	return &idleReader{r, it}
+}
+
+func (it *idleTimer) Writer(w io.Writer) io.Writer {
+	if it == nil {
+		return w
+	}
+	return &idleWriter{w, it}
+}
+
+type idleReader struct {
+	r  io.Reader
+	it *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.it.touch()
+	}
+	return n, err
+}
+
+type idleWriter struct {
+	w  io.Writer
+	it *idleTimer
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.it.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	acceptedConns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wsh",
+		Name:      "accepted_connections_total",
+		Help:      "Accepted local connections.",
+	}, []string{"port"})
+
+	activeStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "wsh",
+		Name:      "active_streams",
+		Help:      "Streams being tunneled.",
+	}, []string{"port"})
+
+	streamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wsh",
+		Name:      "stream_bytes_total",
+		Help:      "Bytes of finished streams, direction is up or down.",
+	}, []string{"port", "direction"})
+
+	roundTripSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "wsh",
+		Name:      "roundtrip_seconds",
+		Help:      "Time to response headers of requests to the server, kind is connect, reverse or inner.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"port", "kind"})
+
+	dialTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wsh",
+		Name:      "dial_total",
+		Help:      "Dials to the server, result is ok or the failed step.",
+	}, []string{"port", "scheme", "result"})
+
+	pingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "wsh",
+		Name:      "ping_rtt_seconds",
+		Help:      "Ping round trip time, source is ok for HOST_OK requests or pong for websocket pongs.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"port", "source"})
+
+	pacFetchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wsh",
+		Name:      "pac_fetch_total",
+		Help:      "Pac fetches, result is ok, not_modified, cached or error.",
+	}, []string{"port", "result"})
+
+	rttSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "wsh",
+		Name:      "rtt_seconds",
+		Help:      "Smoothed round trip time to the server, stat is ewma or jitter.",
+	}, []string{"port", "stat"})
+
+	missedPongs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wsh",
+		Name:      "missed_pongs_total",
+		Help:      "Websocket pings without a pong before the next ping.",
+	}, []string{"port"})
+
+	h2Conns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "wsh",
+		Name:      "h2_connections",
+		Help:      "Open h2 connections to the server.",
+	}, []string{"port"})
+)
+
+func init() {
+	prometheus.MustRegister(acceptedConns, activeStreams, streamBytes, roundTripSeconds,
+		dialTotal, pingSeconds, rttSeconds, missedPongs, pacFetchTotal, h2Conns)
+}
+
+// instrumentedTransport observes RoundTrip latency of the h2 transport and
+// traces it, the trace context is sent to the server if PropagateTrace.
+type instrumentedTransport struct {
+	http.RoundTripper
+	client *Client
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	kind := "reverse"
+	switch {
+	case req.Method == "CONNECT":
+		kind = "connect"
+	case strings.HasPrefix(req.Host, "i:"):
+		kind = "inner"
+	}
+	ctx, span := startSpan(req.Context(), "RoundTrip "+kind,
+		attribute.String("wsh.port", t.client.Port),
+		attribute.String("wsh.target", req.Host))
+	req = req.WithContext(ctx)
+	if t.client.PropagateTrace && kind != "inner" {
+		req.Header = req.Header.Clone()
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+		injectTrace(ctx, req.Header)
+	}
+
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err == nil {
+		roundTripSeconds.WithLabelValues(t.client.Port, kind).Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	}
+	endSpan(span, err)
+	return res, err
+}
+
+func observeDial(port, scheme string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		if de, ok := err.(*DialError); ok {
+			result = de.Op
+		}
+	}
+	dialTotal.WithLabelValues(port, scheme, result).Inc()
+}
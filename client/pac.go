@@ -0,0 +1,276 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	pacCacheSize = 4096
+	pacRuntimes  = 4 // evaluating at the same time, lookups may block one
+)
+
+// pacTimeout interrupts a FindProxyForURL, like of an endless loop.
+var pacTimeout = 5 * time.Second
+
+// PacEvaluator runs FindProxyForURL of a pac script, results are cached per
+// url. A goja.Runtime is not goroutine safe, so each evaluation takes one
+// from a small pool. An evaluation is interrupted after pacTimeout and its
+// runtime is dropped.
+type PacEvaluator struct {
+	prog  *goja.Program
+	idle  chan *pacRuntime
+	slots chan struct{} // one per runtime created
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+type pacRuntime struct {
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+// NewPacEvaluator executes tpl with the local proxy address and compiles the
+// resulting script.
+func NewPacEvaluator(tpl *template.Template, localAddr string) (*PacEvaluator, error) {
+	var script bytes.Buffer
+	if err := tpl.Execute(&script, localAddr); err != nil {
+		return nil, err
+	}
+	return NewPacScript(script.String())
+}
+
+func NewPacScript(script string) (*PacEvaluator, error) {
+	prog, err := goja.Compile("pac", script, false)
+	if err != nil {
+		return nil, fmt.Errorf("pac: %v", err)
+	}
+	rt, err := newPacRuntime(prog)
+	if err != nil {
+		return nil, err
+	}
+	p := &PacEvaluator{
+		prog:  prog,
+		idle:  make(chan *pacRuntime, pacRuntimes),
+		slots: make(chan struct{}, pacRuntimes),
+		cache: make(map[string]string),
+	}
+	p.slots <- struct{}{}
+	p.idle <- rt
+	return p, nil
+}
+
+func newPacRuntime(prog *goja.Program) (*pacRuntime, error) {
+	vm := goja.New()
+	for name, fn := range pacFuncs {
+		vm.Set(name, fn)
+	}
+	if _, err := vm.RunProgram(prog); err != nil {
+		return nil, fmt.Errorf("pac: %v", err)
+	}
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("pac: FindProxyForURL is not defined")
+	}
+	return &pacRuntime{vm: vm, find: find}, nil
+}
+
+// runtime takes an idle runtime, or creates one while under pacRuntimes.
+func (p *PacEvaluator) runtime() (*pacRuntime, error) {
+	select {
+	case rt := <-p.idle:
+		return rt, nil
+	default:
+	}
+	select {
+	case rt := <-p.idle:
+		return rt, nil
+	case p.slots <- struct{}{}:
+		rt, err := newPacRuntime(p.prog)
+		if err != nil {
+			<-p.slots
+		}
+		return rt, err
+	}
+}
+
+// FindProxyForURL returns the raw pac result, like "PROXY a:1; DIRECT".
+func (p *PacEvaluator) FindProxyForURL(rawurl, host string) (string, error) {
+	p.mu.Lock()
+	result, ok := p.cache[rawurl]
+	p.mu.Unlock()
+	if ok {
+		return result, nil
+	}
+
+	rt, err := p.runtime()
+	if err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(pacTimeout, func() { rt.vm.Interrupt("pac timeout") })
+	v, err := rt.find(goja.Undefined(), rt.vm.ToValue(rawurl), rt.vm.ToValue(host))
+	if err == nil {
+		result = v.String()
+	}
+	if timer.Stop() {
+		p.idle <- rt
+	} else {
+		<-p.slots // interrupted or about to be, a new runtime replaces it
+	}
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= pacCacheSize {
+		p.cache = make(map[string]string)
+	}
+	p.cache[rawurl] = result
+	return result, nil
+}
+
+// Route evaluates pac for target host:port. The first entry decides, DIRECT
+// goes DIRECT, any proxy goes through the tunnel.
+func (p *PacEvaluator) Route(target string) (Action, *Rule) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	rawurl := "http://" + target + "/"
+	if port == "443" {
+		rawurl = "https://" + host + "/"
+	}
+
+	result, err := p.FindProxyForURL(rawurl, strings.Trim(host, "[]"))
+	if err != nil {
+		log.WithError(err).Debugln("FindProxyForURL", target)
+		return PROXY, nil
+	}
+	return pacAction(result), &Rule{Type: "PAC", Value: result, Action: pacAction(result)}
+}
+
+func pacAction(result string) Action {
+	first := strings.TrimSpace(strings.SplitN(result, ";", 2)[0])
+	if strings.EqualFold(first, "DIRECT") || first == "" {
+		return DIRECT
+	}
+	return PROXY
+}
+
+// pac helper functions, see
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+var pacFuncs = map[string]interface{}{
+	"isPlainHostName": func(host string) bool {
+		return !strings.Contains(host, ".")
+	},
+	"dnsDomainIs": func(host, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	},
+	"localHostOrDomainIs": func(host, hostdom string) bool {
+		host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+		return host == hostdom || (!strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."))
+	},
+	"isResolvable": func(host string) bool {
+		return pacResolve(host) != ""
+	},
+	"dnsResolve": func(host string) interface{} {
+		if ip := pacResolve(host); ip != "" {
+			return ip
+		}
+		return nil
+	},
+	"isInNet": func(host, pattern, mask string) bool {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ip = net.ParseIP(pacResolve(host))
+		}
+		p, m := net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+		if ip = ip.To4(); ip == nil || p == nil || m == nil {
+			return false
+		}
+		return ip.Mask(net.IPMask(m)).Equal(p.Mask(net.IPMask(m)))
+	},
+	"myIpAddress": func() string {
+		return myIpAddress()
+	},
+	"dnsDomainLevels": func(host string) int {
+		return strings.Count(host, ".")
+	},
+	"shExpMatch": func(str, shexp string) bool {
+		re, err := shExpRegexp(shexp)
+		return err == nil && re.MatchString(str)
+	},
+}
+
+func pacResolve(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			return ip4.String()
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0].IP.String()
+	}
+	return ""
+}
+
+func myIpAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				return ip4.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+var (
+	shExpCache   = make(map[string]*regexp.Regexp)
+	muShExpCache sync.Mutex
+)
+
+// shExpRegexp converts a shell expression with * and ? to a regexp.
+func shExpRegexp(shexp string) (*regexp.Regexp, error) {
+	muShExpCache.Lock()
+	defer muShExpCache.Unlock()
+	if re, ok := shExpCache[shexp]; ok {
+		return re, nil
+	}
+	quoted := regexp.QuoteMeta(shexp)
+	quoted = strings.Replace(quoted, `\*`, ".*", -1)
+	quoted = strings.Replace(quoted, `\?`, ".", -1)
+	re, err := regexp.Compile("^" + quoted + "$")
+	if err != nil {
+		return nil, err
+	}
+	if len(shExpCache) >= pacCacheSize {
+		shExpCache = make(map[string]*regexp.Regexp)
+	}
+	shExpCache[shexp] = re
+	return re, nil
+}
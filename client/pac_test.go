@@ -0,0 +1,92 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacFuncs(t *testing.T) {
+	p, err := NewPacScript(`
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host)) return "DIRECT";
+	if (dnsDomainIs(host, ".example.com")) return "PROXY a:1";
+	if (shExpMatch(url, "https://*")) return "PROXY b:1; DIRECT";
+	if (isInNet(host, "10.0.0.0", "255.0.0.0")) return "DIRECT";
+	if (localHostOrDomainIs(host, "www.test")) return "DIRECT";
+	return "PROXY c:" + dnsDomainLevels(host);
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		want   string
+		action Action
+	}{
+		{"intranet:80", "DIRECT", DIRECT},
+		{"www.example.com:80", "PROXY a:1", PROXY},
+		{"other.test:443", "PROXY b:1; DIRECT", PROXY},
+		{"other.test:80", "PROXY c:1", PROXY},
+		{"10.1.2.3:80", "DIRECT", DIRECT},
+		{"www.test:80", "DIRECT", DIRECT},
+		{"a.b.c.test:8080", "PROXY c:3", PROXY},
+	}
+	for _, tt := range tests {
+		action, rule := p.Route(tt.target)
+		if action != tt.action || rule == nil || rule.Value != tt.want {
+			t.Errorf("Route(%s) = %s, %v, want %s, %s", tt.target, action, rule, tt.action, tt.want)
+		}
+	}
+}
+
+func TestPacCacheByURL(t *testing.T) {
+	p, err := NewPacScript(`function FindProxyForURL(url, host) { return url.substring(0, 5) == "https" ? "PROXY a:1" : "DIRECT"; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := p.Route("example.com:443"); got != PROXY {
+		t.Errorf("https: %s", got)
+	}
+	if got, _ := p.Route("example.com:80"); got != DIRECT {
+		t.Errorf("http after https: %s", got)
+	}
+}
+
+func TestPacTimeout(t *testing.T) {
+	defer func(d time.Duration) { pacTimeout = d }(pacTimeout)
+	pacTimeout = 50 * time.Millisecond
+	p, err := NewPacScript(`function FindProxyForURL(url, host) { if (host == "loop") for (;;) {} return "DIRECT"; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < pacRuntimes+1; i++ {
+		if _, err := p.FindProxyForURL("http://loop/", "loop"); err == nil {
+			t.Fatal("endless loop not interrupted")
+		}
+	}
+	if result, err := p.FindProxyForURL("http://ok/", "ok"); err != nil || result != "DIRECT" {
+		t.Errorf("after timeouts: %q, %v", result, err)
+	}
+}
+
+func TestShExpRegexp(t *testing.T) {
+	tests := []struct {
+		str, shexp string
+		want       bool
+	}{
+		{"www.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"a.b", "a?b", true},
+		{"a+b", "a+b", true},
+		{"aab", "a+b", false},
+	}
+	for _, tt := range tests {
+		re, err := shExpRegexp(tt.shexp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchString(tt.str); got != tt.want {
+			t.Errorf("shExpMatch(%q, %q) = %v", tt.str, tt.shexp, got)
+		}
+	}
+}
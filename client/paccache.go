@@ -0,0 +1,200 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// pacMeta is saved next to the cached pac.
+type pacMeta struct {
+	Source  string    `json:"source"`
+	ETag    string    `json:"etag,omitempty"`
+	Version string    `json:"version"` // sha256 prefix of the pac
+	Fetched time.Time `json:"fetched"`
+}
+
+// pacSource is where the listener gets its pac from: PacSource if set,
+// otherwise the server.
+func (client *Client) pacSource() string {
+	if client.PacSource != "" {
+		return client.PacSource
+	}
+	return "wsh://" + client.ServerUrl.Host
+}
+
+func (client *Client) pacCacheFile() string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, client.pacSource())
+	return filepath.Join(client.PacCacheDir, "pac-"+name)
+}
+
+func (client *Client) readPacCache() ([]byte, *pacMeta, error) {
+	file := client.pacCacheFile()
+	body, err := ioutil.ReadFile(file + ".tpl")
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta pacMeta
+	b, err := ioutil.ReadFile(file + ".json")
+	if err == nil {
+		err = json.Unmarshal(b, &meta)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, &meta, nil
+}
+
+func (client *Client) writePacCache(body []byte, meta *pacMeta) error {
+	if err := os.MkdirAll(client.PacCacheDir, 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := client.pacCacheFile()
+	if err = ioutil.WriteFile(file+".tpl", body, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file+".json", b, 0600)
+}
+
+// fetchPacSource fetches the pac, body is nil if not modified since etag.
+func (client *Client) fetchPacSource(etag string) (body []byte, newEtag string, err error) {
+	var res *http.Response
+	if u, perr := url.Parse(client.PacSource); client.PacSource == "" || perr != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		if client.PacSource != "" {
+			body, err = ioutil.ReadFile(client.PacSource)
+			return
+		}
+		req := client.innerRequest("GET", HOST_PAC)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if res, err = client.h2Transport.RoundTrip(req); err != nil {
+			return
+		}
+	} else {
+		req, _ := http.NewRequest("GET", client.PacSource, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if res, err = client.HTTPClient().Do(req); err != nil {
+			return
+		}
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+		body, err = ioutil.ReadAll(res.Body)
+		return body, res.Header.Get("ETag"), err
+	}
+	return nil, "", fmt.Errorf("fetch pac: %s", res.Status)
+}
+
+// LoadPac fetches the pac of the listener and caches it in PacCacheDir. The
+// cached copy is used when the source is not reachable.
+func (client *Client) LoadPac() (*template.Template, string, error) {
+	var cached []byte
+	var meta *pacMeta
+	if client.PacCacheDir != "" {
+		cached, meta, _ = client.readPacCache()
+	}
+	etag := ""
+	if meta != nil {
+		etag = meta.ETag
+	}
+
+	body, etag, err := client.fetchPacSource(etag)
+	fresh := err == nil
+	switch {
+	case err != nil && cached == nil:
+		pacFetchTotal.WithLabelValues(client.Port, "error").Inc()
+		return nil, "", err
+	case err != nil:
+		pacFetchTotal.WithLabelValues(client.Port, "cached").Inc()
+		log.WithError(err).WithField("port", client.Port).Warnln("pac source not reachable, using cached pac", meta.Version)
+		body = cached
+	case body == nil:
+		pacFetchTotal.WithLabelValues(client.Port, "not_modified").Inc()
+		body = cached
+		meta.Fetched = time.Now()
+	default:
+		pacFetchTotal.WithLabelValues(client.Port, "ok").Inc()
+		sum := sha256.Sum256(body)
+		meta = &pacMeta{
+			Source:  client.pacSource(),
+			ETag:    etag,
+			Version: hex.EncodeToString(sum[:8]),
+			Fetched: time.Now(),
+		}
+	}
+
+	tpl, err := template.New("pac").Parse(string(body))
+	if err != nil {
+		return nil, "", err
+	}
+	if client.PacCacheDir != "" && fresh {
+		if err := client.writePacCache(body, meta); err != nil {
+			log.WithError(err).Warnln("cache pac")
+		}
+	}
+	return tpl, meta.Version, nil
+}
+
+// RefreshPac reloads the pac every period, it never returns. version is
+// of the pac set initially.
+func (client *Client) RefreshPac(period time.Duration, version string) {
+	client.muReload.Lock()
+	client.pacVersion = version
+	client.muReload.Unlock()
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := client.ReloadPac(); err != nil {
+			log.WithError(err).WithField("port", client.Port).Errorln("refresh pac")
+		}
+	}
+}
+
+// ReloadPac loads the pac and sets it if its version changed. Reloads of the
+// ticker and of ServerInfo changes run one at a time, so an older pac never
+// replaces a newer one.
+func (client *Client) ReloadPac() error {
+	client.muReload.Lock()
+	defer client.muReload.Unlock()
+	tpl, v, err := client.LoadPac()
+	if err != nil {
+		return err
+	}
+	version := client.pacVersion
+	if v == version {
+		return nil
+	}
+	if err = client.SetPac(tpl); err != nil {
+		return err
+	}
+	client.pacVersion = v
+	log.WithField("port", client.Port).Infoln("pac updated", version, "=>", v)
+	return nil
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"net"
 	"time"
 
@@ -64,6 +65,8 @@ func chanFromWs(ws *websocket.Conn) chan []byte {
 func (client *Client) pipe(conn net.Conn, ws *websocket.Conn) {
 	cc := chanFromConn(conn, client.BufSize)
 	cw := chanFromWs(ws)
+	shape := client.Shaper.Stream(context.Background(), client.Port, remoteIP(conn.RemoteAddr().String()), "")
+	defer shape.Close()
 	ticker := time.NewTicker(client.PingPeriod)
 
 	defer func() {
@@ -81,6 +84,7 @@ func (client *Client) pipe(conn net.Conn, ws *websocket.Conn) {
 			if b == nil {
 				return
 			} else {
+				shape.WaitUp(len(b))
 				// in write there is timeout set
 				if err := ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
 					log.WithField("port", client.Port).Infoln("write request error", err)
@@ -91,6 +95,7 @@ func (client *Client) pipe(conn net.Conn, ws *websocket.Conn) {
 			if b == nil {
 				return
 			} else {
+				shape.WaitDown(len(b))
 				if _, err := conn.Write(b); err != nil {
 					log.WithField("port", client.Port).Infoln("write response error", err)
 					return
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// poolDialTimeout bounds a dial of the pool, which outlives the request
+// that started it.
+const poolDialTimeout = 30 * time.Second
+
+// connPool keeps the h2 conns to the server. A conn is added only after
+// dialProxyTLS checked the ServerInfo over it, requests never go to a conn
+// of an incompatible server.
+type connPool struct {
+	client *Client
+	mu     sync.Mutex
+	conns  []*http2.ClientConn
+	dial   *dialCall // in flight, nil if none
+}
+
+// dialCall is a dial shared by the requests waiting for a conn.
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// GetClientConn returns a conn with a free stream, it dials when there is
+// none. A single dial runs at a time outside the lock, waiting requests
+// give up when their context is done and the dial goes on for the others.
+func (p *connPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	for {
+		p.mu.Lock()
+		for _, cc := range p.conns {
+			if cc.ReserveNewRequest() {
+				p.mu.Unlock()
+				return cc, nil
+			}
+		}
+		call := p.dial
+		if call == nil {
+			call = &dialCall{done: make(chan struct{})}
+			p.dial = call
+			// keeps the trace of req, not its cancelation
+			go p.dialConn(context.WithoutCancel(req.Context()), call, addr)
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		// the new conn may be taken by other waiters, look again
+	}
+}
+
+func (p *connPool) dialConn(ctx context.Context, call *dialCall, addr string) {
+	ctx, cancel := context.WithTimeout(ctx, poolDialTimeout)
+	defer cancel()
+	cc, err := p.client.dialProxyTLS(ctx, "tcp", addr, p.client.h2.TLSClientConfig.Clone())
+
+	p.mu.Lock()
+	if err == nil {
+		p.conns = append(p.conns, cc)
+	}
+	call.err = err
+	p.dial = nil
+	p.mu.Unlock()
+	close(call.done)
+}
+
+// MarkDead removes a closed conn.
+func (p *connPool) MarkDead(dead *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, cc := range p.conns {
+		if cc == dead {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	FRAME_OUT = "out" // client to server
+	FRAME_IN  = "in"  // server to client
+)
+
+// RecordedFrame is a line of a frame recording, Frame is the raw frame with
+// its header, or the client preface.
+type RecordedFrame struct {
+	Time     time.Duration `json:"t"`
+	Dir      string        `json:"dir"`
+	Type     string        `json:"type"`
+	StreamID uint32        `json:"stream,omitempty"`
+	Flags    uint8         `json:"flags,omitempty"`
+	Length   int           `json:"len"`
+	Frame    []byte        `json:"frame"`
+}
+
+// FrameRecorder is a net.Conn that records the h2 frames of the inner tls
+// conn to a file as json lines.
+type FrameRecorder struct {
+	net.Conn
+
+	start time.Time
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+	out   frameSplitter
+	in    frameSplitter
+}
+
+// RecordConn records c to a new file in dir named by port and time.
+func RecordConn(c net.Conn, dir, port string) (*FrameRecorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, port+"-"+time.Now().Format("20060102-150405.000000")+".frames")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &FrameRecorder{Conn: c, start: time.Now(), f: f, w: bufio.NewWriter(f)}
+	r.enc = json.NewEncoder(r.w)
+	r.out = frameSplitter{preface: true}
+	return r, nil
+}
+
+func (r *FrameRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.record(FRAME_IN, &r.in, p[:n])
+	}
+	return n, err
+}
+
+func (r *FrameRecorder) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	if n > 0 {
+		r.record(FRAME_OUT, &r.out, p[:n])
+	}
+	return n, err
+}
+
+// Close closes the conn and flushes the recording.
+func (r *FrameRecorder) Close() error {
+	err := r.Conn.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.w.Flush()
+		r.f.Close()
+		r.f = nil
+	}
+	return err
+}
+
+func (r *FrameRecorder) record(dir string, s *frameSplitter, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return
+	}
+	t := time.Since(r.start)
+	for _, frame := range s.split(p) {
+		rf := RecordedFrame{Time: t, Dir: dir, Length: len(frame), Frame: frame}
+		if s.preface {
+			rf.Type = "PREFACE"
+			s.preface = false
+		} else {
+			rf.Type = http2.FrameType(frame[3]).String()
+			rf.Flags = frame[4]
+			rf.StreamID = binary.BigEndian.Uint32(frame[5:]) & (1<<31 - 1)
+		}
+		if err := r.enc.Encode(&rf); err != nil {
+			log.WithError(err).Errorln("record frames")
+			r.f.Close()
+			r.f = nil
+			return
+		}
+	}
+	r.w.Flush()
+}
+
+// frameSplitter cuts a byte stream into whole frames, the first is the
+// client preface if preface.
+type frameSplitter struct {
+	preface bool
+	buf     []byte
+}
+
+func (s *frameSplitter) split(p []byte) [][]byte {
+	s.buf = append(s.buf, p...)
+	var frames [][]byte
+	for {
+		n := len(http2.ClientPreface)
+		if !s.preface || len(frames) > 0 {
+			if len(s.buf) < 9 {
+				break
+			}
+			n = 9 + (int(s.buf[0])<<16 | int(s.buf[1])<<8 | int(s.buf[2]))
+		}
+		if len(s.buf) < n {
+			break
+		}
+		frames = append(frames, s.buf[:n:n])
+		s.buf = s.buf[n:]
+	}
+	return frames
+}
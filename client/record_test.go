@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestFrameSplitter(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&buf, nil)
+	fr.WriteSettings()
+	fr.WriteData(1, false, []byte("hello"))
+	fr.WritePing(false, [8]byte{})
+	stream := buf.Bytes()
+	want := []int{len(http2.ClientPreface), 9, 9 + 5, 9 + 8}
+
+	tests := []struct {
+		name  string
+		chunk int // bytes per write
+	}{
+		{"whole", len(stream)},
+		{"bytes", 1},
+		{"odd", 7},
+		{"header", 9},
+	}
+	for _, tt := range tests {
+		s := frameSplitter{preface: true}
+		var got []int
+		for p := stream; len(p) > 0; {
+			n := tt.chunk
+			if n > len(p) {
+				n = len(p)
+			}
+			for _, f := range s.split(p[:n]) {
+				got = append(got, len(f))
+				s.preface = false // as record does
+			}
+			p = p[n:]
+		}
+		if len(got) != len(want) || len(s.buf) != 0 {
+			t.Errorf("%s: frames %v, want %v", tt.name, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: frames %v, want %v", tt.name, got, want)
+				break
+			}
+		}
+	}
+}
+
+// recording writes frames as RecordConn does.
+type recording struct {
+	t    *testing.T
+	enc  *json.Encoder
+	hbuf bytes.Buffer
+	henc map[string]*hpack.Encoder
+}
+
+func (r *recording) frame(dir string, write func(fr *http2.Framer) error) {
+	var buf bytes.Buffer
+	if err := write(http2.NewFramer(&buf, nil)); err != nil {
+		r.t.Fatal(err)
+	}
+	f := buf.Bytes()
+	if err := r.enc.Encode(&RecordedFrame{Dir: dir, Type: http2.FrameType(f[3]).String(), Length: len(f), Frame: f}); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *recording) block(dir string, fields ...string) []byte {
+	r.hbuf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		r.henc[dir].WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), r.hbuf.Bytes()...)
+}
+
+func TestDecodeRecording(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "1080.frames")
+	var out bytes.Buffer
+	r := &recording{t: t, enc: json.NewEncoder(&out)}
+	r.henc = map[string]*hpack.Encoder{FRAME_OUT: hpack.NewEncoder(&r.hbuf), FRAME_IN: hpack.NewEncoder(&r.hbuf)}
+
+	r.enc.Encode(&RecordedFrame{Dir: FRAME_OUT, Type: "PREFACE", Frame: []byte(http2.ClientPreface)})
+	r.frame(FRAME_OUT, func(fr *http2.Framer) error { return fr.WriteSettings() })
+	r.frame(FRAME_IN, func(fr *http2.Framer) error { return fr.WriteSettings() })
+
+	// stream 1: a request split by CONTINUATION, a 100, data and trailers
+	req := r.block(FRAME_OUT, ":method", "GET", ":scheme", "https", ":authority", "example.com", ":path", "/a")
+	r.frame(FRAME_OUT, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: req[:3], EndStream: true})
+	})
+	r.frame(FRAME_OUT, func(fr *http2.Framer) error { return fr.WriteContinuation(1, true, req[3:]) })
+	r.frame(FRAME_IN, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: r.block(FRAME_IN, ":status", "100"), EndHeaders: true})
+	})
+	r.frame(FRAME_IN, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: r.block(FRAME_IN, ":status", "200", "content-type", "text/plain"), EndHeaders: true})
+	})
+	r.frame(FRAME_IN, func(fr *http2.Framer) error { return fr.WriteData(1, false, []byte("hello ")) })
+	r.frame(FRAME_IN, func(fr *http2.Framer) error { return fr.WriteData(1, false, []byte("world")) })
+	r.frame(FRAME_IN, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: r.block(FRAME_IN, "x-done", "1"), EndHeaders: true, EndStream: true})
+	})
+
+	// stream 3: reset by the server, same dynamic table
+	r.frame(FRAME_OUT, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: r.block(FRAME_OUT, ":method", "GET", ":scheme", "https", ":authority", "example.com", ":path", "/b"), EndHeaders: true, EndStream: true})
+	})
+	r.frame(FRAME_IN, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: r.block(FRAME_IN, ":status", "200"), EndHeaders: true})
+	})
+	r.frame(FRAME_IN, func(fr *http2.Framer) error { return fr.WriteRSTStream(3, http2.ErrCodeInternal) })
+
+	// stream 5: never answered
+	r.frame(FRAME_OUT, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 5, BlockFragment: r.block(FRAME_OUT, ":method", "GET", ":scheme", "https", ":authority", "example.com", ":path", "/c"), EndHeaders: true, EndStream: true})
+	})
+
+	if err := ioutil.WriteFile(file, out.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	streams, err := decodeRecording(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("%d streams, want 2", len(streams))
+	}
+
+	st := streams[0]
+	if st.method != "GET" || st.authority != "example.com" || st.path != "/a" || st.status != 200 {
+		t.Errorf("stream 1: %s %s%s %d", st.method, st.authority, st.path, st.status)
+	}
+	if got := st.header.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("content-type %q", got)
+	}
+	if got := st.trailer.Get("X-Done"); got != "1" {
+		t.Errorf("trailer x-done %q", got)
+	}
+	var body []byte
+	for _, d := range st.data {
+		body = append(body, d.data...)
+	}
+	if string(body) != "hello world" || st.reset {
+		t.Errorf("body %q, reset %v", body, st.reset)
+	}
+
+	if st = streams[1]; st.path != "/b" || !st.reset {
+		t.Errorf("stream 3: path %s, reset %v", st.path, st.reset)
+	}
+}
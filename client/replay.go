@@ -0,0 +1,276 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// recordedStream is a request and its response decoded from a recording.
+type recordedStream struct {
+	method    string
+	authority string
+	path      string
+	start     time.Duration
+
+	status  int
+	header  http.Header
+	trailer http.Header
+	data    []recordedData
+	reset   bool
+	used    bool
+}
+
+type recordedData struct {
+	t    time.Duration // since the response headers
+	data []byte
+}
+
+// ReplayServer serves the responses of recorded frames to the client over
+// plain h2, so connect can be tested without a wsh server. A request is
+// answered by the first unused recorded stream with the same method,
+// authority and path. Requests to inner hosts reuse the last one when all
+// are used.
+type ReplayServer struct {
+	Pace bool // keep the recorded delays between data frames
+
+	mu      sync.Mutex
+	streams []*recordedStream
+}
+
+// LoadReplay decodes recordings made by RecordConn.
+func LoadReplay(files ...string) (*ReplayServer, error) {
+	s := &ReplayServer{}
+	for _, file := range files {
+		streams, err := decodeRecording(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		s.streams = append(s.streams, streams...)
+	}
+	return s, nil
+}
+
+// decodeRecording decodes the streams of a connection, the hpack state is
+// kept per direction like the recorded peers did.
+func decodeRecording(file string) ([]*recordedStream, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoders := map[string]*hpack.Decoder{
+		FRAME_OUT: hpack.NewDecoder(4096, nil),
+		FRAME_IN:  hpack.NewDecoder(4096, nil),
+	}
+	// a framer per direction checks CONTINUATION follows its HEADERS
+	feeds := map[string]*bytes.Reader{FRAME_OUT: bytes.NewReader(nil), FRAME_IN: bytes.NewReader(nil)}
+	framers := map[string]*http2.Framer{
+		FRAME_OUT: http2.NewFramer(nil, feeds[FRAME_OUT]),
+		FRAME_IN:  http2.NewFramer(nil, feeds[FRAME_IN]),
+	}
+	blocks := make(map[string][]byte) // header blocks waiting for CONTINUATION
+	byID := make(map[uint32]*recordedStream)
+	var streams []*recordedStream
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<25)
+	for sc.Scan() {
+		var rf RecordedFrame
+		if err := json.Unmarshal(sc.Bytes(), &rf); err != nil {
+			return nil, err
+		}
+		if rf.Type == "PREFACE" {
+			continue
+		}
+		feed, ok := feeds[rf.Dir]
+		if !ok {
+			return nil, fmt.Errorf("unknown frame direction %q", rf.Dir)
+		}
+		feed.Reset(rf.Frame)
+		fr, err := framers[rf.Dir].ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		var block []byte
+		var endHeaders bool
+		switch fr := fr.(type) {
+		case *http2.SettingsFrame:
+			if rf.Dir == FRAME_IN {
+				// the client encoder follows the table size of the server
+				if v, ok := fr.Value(http2.SettingHeaderTableSize); ok {
+					decoders[FRAME_OUT].SetAllowedMaxDynamicTableSize(v)
+				}
+			} else if v, ok := fr.Value(http2.SettingHeaderTableSize); ok {
+				decoders[FRAME_IN].SetAllowedMaxDynamicTableSize(v)
+			}
+			continue
+		case *http2.HeadersFrame:
+			block, endHeaders = fr.HeaderBlockFragment(), fr.HeadersEnded()
+		case *http2.ContinuationFrame:
+			block, endHeaders = fr.HeaderBlockFragment(), fr.HeadersEnded()
+		case *http2.DataFrame:
+			if st := byID[rf.StreamID]; st != nil && rf.Dir == FRAME_IN && len(fr.Data()) > 0 {
+				st.data = append(st.data, recordedData{rf.Time - st.start, append([]byte(nil), fr.Data()...)})
+			}
+			continue
+		case *http2.RSTStreamFrame:
+			if st := byID[rf.StreamID]; st != nil && rf.Dir == FRAME_IN {
+				st.reset = true
+			}
+			continue
+		default:
+			continue
+		}
+
+		key := rf.Dir + strconv.FormatUint(uint64(rf.StreamID), 10)
+		blocks[key] = append(blocks[key], block...)
+		if !endHeaders {
+			continue
+		}
+		fields, err := decoders[rf.Dir].DecodeFull(blocks[key])
+		delete(blocks, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if rf.Dir == FRAME_OUT {
+			st := &recordedStream{}
+			for _, hf := range fields {
+				switch hf.Name {
+				case ":method":
+					st.method = hf.Value
+				case ":authority":
+					st.authority = hf.Value
+				case ":path":
+					st.path = hf.Value
+				}
+			}
+			if st.method != "" { // not request trailers
+				byID[rf.StreamID] = st
+				streams = append(streams, st)
+			}
+			continue
+		}
+
+		st := byID[rf.StreamID]
+		if st == nil {
+			continue
+		}
+		h := make(http.Header)
+		status := 0
+		for _, hf := range fields {
+			if hf.Name == ":status" {
+				status, _ = strconv.Atoi(hf.Value)
+				continue
+			}
+			h.Add(hf.Name, hf.Value)
+		}
+		switch {
+		case status >= 100 && status < 200: // informational
+		case st.status == 0:
+			st.status, st.header, st.start = status, h, rf.Time
+		default:
+			st.trailer = h
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	// drop requests never answered
+	answered := streams[:0]
+	for _, st := range streams {
+		if st.status != 0 {
+			answered = append(answered, st)
+		}
+	}
+	return answered, nil
+}
+
+// Serve serves each accepted conn as plain h2 with prior knowledge.
+func (s *ReplayServer) Serve(l net.Listener) error {
+	h2 := &http2.Server{}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go h2.ServeConn(c, &http2.ServeConnOpts{Handler: s})
+	}
+}
+
+func (s *ReplayServer) take(r *http.Request) *recordedStream {
+	path := r.URL.RequestURI()
+	if r.Method == "CONNECT" {
+		path = ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last *recordedStream
+	for _, st := range s.streams {
+		if st.method == r.Method && st.authority == r.Host && st.path == path {
+			if !st.used {
+				st.used = true
+				return st
+			}
+			last = st
+		}
+	}
+	// inner hosts like the pings are asked more often than recorded
+	if strings.HasPrefix(r.Host, "i:") {
+		return last
+	}
+	return nil
+}
+
+func (s *ReplayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := s.take(r)
+	if st == nil {
+		log.Debugln("replay: no recorded stream for", r.Method, r.Host, r.URL.RequestURI())
+		http.Error(w, "no recorded stream", http.StatusBadGateway)
+		return
+	}
+	go io.Copy(ioutil.Discard, r.Body)
+
+	for k, vs := range st.header {
+		w.Header()[http.CanonicalHeaderKey(k)] = vs
+	}
+	for k := range st.trailer {
+		w.Header().Add("Trailer", http.CanonicalHeaderKey(k))
+	}
+	w.WriteHeader(st.status)
+	w.(http.Flusher).Flush()
+
+	start := time.Now()
+	for _, d := range st.data {
+		if s.Pace {
+			time.Sleep(d.t - time.Since(start))
+		}
+		if _, err := w.Write(d.data); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+	}
+	if st.reset {
+		panic(http.ErrAbortHandler)
+	}
+	for k, vs := range st.trailer {
+		w.Header()[http.CanonicalHeaderKey(k)] = vs
+	}
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+// Proxy-Status error types, see RFC 9209 section 2.3
+const (
+	PS_DNS_TIMEOUT              = "dns_timeout"
+	PS_DNS_ERROR                = "dns_error"
+	PS_CONNECTION_REFUSED       = "connection_refused"
+	PS_CONNECTION_TIMEOUT       = "connection_timeout"
+	PS_CONNECTION_LIMIT_REACHED = "connection_limit_reached"
+	PS_TLS_PROTOCOL_ERROR       = "tls_protocol_error"
+	PS_TLS_CERTIFICATE_ERROR    = "tls_certificate_error"
+	PS_HTTP_REQUEST_ERROR       = "http_request_error"
+	PS_HTTP_REQUEST_DENIED      = "http_request_denied"
+	PS_DESTINATION_UNAVAILABLE  = "destination_unavailable"
+	PS_PROXY_INTERNAL_ERROR     = "proxy_internal_error"
+
+	proxyStatusName = "wsh"
+)
+
+// DialError is returned by DialProxyTLS, Op tells which step failed:
+// "dial", "auth", "tls", "alpn", "h2" or "info".
+type DialError struct {
+	Scheme string
+	Op     string
+	Err    error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("dial %s %s: %v", e.Scheme, e.Op, e.Err)
+}
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+// ProxyError describes a failed request and renders the response sent back
+// to the local client.
+type ProxyError struct {
+	Status   int
+	Type     string
+	Details  string
+	Received int // status received from the wsh server, 0 if none
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Type, e.Details)
+}
+
+func (e *ProxyError) proxyStatus() string {
+	s := proxyStatusName + "; error=" + e.Type
+	if e.Received != 0 {
+		s += "; received-status=" + strconv.Itoa(e.Received)
+	}
+	if e.Details != "" {
+		s += "; details=" + sfString(e.Details)
+	}
+	return s
+}
+
+// sfString quotes s as a structured field string of RFC 8941, which allows
+// printable ascii only, other bytes are replaced by '?'.
+func sfString(s string) string {
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c > 0x7e:
+			b = append(b, '?')
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(append(b, '"'))
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body><h1>{{.Status}} {{.StatusText}}</h1>
+<p>wsh: {{.Type}}</p>
+<pre>{{.Details}}</pre>
+</body></html>
+`))
+
+// Write writes a complete HTTP/1.1 response with a small html body.
+func (e *ProxyError) Write(w io.Writer) error {
+	var body bytes.Buffer
+	errorPage.Execute(&body, map[string]interface{}{
+		"Status":     e.Status,
+		"StatusText": http.StatusText(e.Status),
+		"Type":       e.Type,
+		"Details":    e.Details,
+	})
+	res := &http.Response{
+		StatusCode:    e.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+	}
+	res.Header.Set("Content-Type", "text/html; charset=utf-8")
+	res.Header.Set("Proxy-Status", e.proxyStatus())
+	return res.Write(w)
+}
+
+func newProxyError(status int, typ string, details string) *ProxyError {
+	return &ProxyError{Status: status, Type: typ, Details: details}
+}
+
+// errorFromStatus maps a non-200 answer of the wsh server.
+func errorFromStatus(status int) *ProxyError {
+	pe := &ProxyError{
+		Status:   http.StatusBadGateway,
+		Type:     PS_DESTINATION_UNAVAILABLE,
+		Details:  "server failed to proxy",
+		Received: status,
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusProxyAuthRequired:
+		pe.Type = PS_HTTP_REQUEST_DENIED
+		pe.Details = "server denied the request"
+	case http.StatusGatewayTimeout:
+		pe.Status = http.StatusGatewayTimeout
+		pe.Type = PS_CONNECTION_TIMEOUT
+		pe.Details = "server timed out connecting to destination"
+	}
+	return pe
+}
+
+// errorFromRoundTrip classifies errors from h2Transport.RoundTrip, which
+// include the errors from DialProxyTLS.
+func errorFromRoundTrip(err error) *ProxyError {
+	pe := &ProxyError{
+		Status:  http.StatusBadGateway,
+		Type:    PS_PROXY_INTERNAL_ERROR,
+		Details: err.Error(),
+	}
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var dialErr *DialError
+	var alert tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		pe.Type = PS_DNS_ERROR
+		if dnsErr.IsTimeout {
+			pe.Status = http.StatusGatewayTimeout
+			pe.Type = PS_DNS_TIMEOUT
+		}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		pe.Type = PS_CONNECTION_REFUSED
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		pe.Status = http.StatusGatewayTimeout
+		pe.Type = PS_CONNECTION_TIMEOUT
+	case errors.As(err, &dialErr) && dialErr.Op == "auth",
+		errors.As(err, &alert) && (alert == 42 || alert == 116): // bad_certificate, certificate_required
+		pe.Type = PS_HTTP_REQUEST_DENIED
+		pe.Details = "wsh server rejected credentials: " + err.Error()
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		pe.Type = PS_TLS_CERTIFICATE_ERROR
+	case errors.As(err, &alert),
+		errors.As(err, &dialErr) && (dialErr.Op == "tls" || dialErr.Op == "alpn"):
+		pe.Type = PS_TLS_PROTOCOL_ERROR
+	}
+	return pe
+}
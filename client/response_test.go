@@ -0,0 +1,32 @@
+package client
+
+import "testing"
+
+func TestSfString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", `""`},
+		{"dial tcp: timeout", `"dial tcp: timeout"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir`, `"C:\\dir"`},
+		{"line\r\nbreak", `"line??break"`},
+		{"tab\there", `"tab?here"`},
+		{"caf\xc3\xa9", `"caf??"`},
+		{"del\x7f", `"del?"`},
+	}
+	for _, tt := range tests {
+		if got := sfString(tt.in); got != tt.want {
+			t.Errorf("sfString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProxyStatus(t *testing.T) {
+	e := &ProxyError{Status: 502, Type: PS_DESTINATION_UNAVAILABLE, Details: "no \"route\"", Received: 503}
+	want := proxyStatusName + "; error=" + PS_DESTINATION_UNAVAILABLE + `; received-status=503; details="no \"route\""`
+	if got := e.proxyStatus(); got != want {
+		t.Errorf("proxyStatus() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,432 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const directDialTimeout = 10 * time.Second
+
+type Action int
+
+const (
+	PROXY Action = iota
+	DIRECT
+	REJECT
+)
+
+var actionNames = []string{"PROXY", "DIRECT", "REJECT"}
+
+func (a Action) String() string {
+	if int(a) < len(actionNames) {
+		return actionNames[a]
+	}
+	return "Action(" + strconv.Itoa(int(a)) + ")"
+}
+
+func ParseAction(s string) (Action, error) {
+	for i, name := range actionNames {
+		if strings.EqualFold(s, name) {
+			return Action(i), nil
+		}
+	}
+	return PROXY, fmt.Errorf("unknown action %q", s)
+}
+
+// routeTarget is the destination being routed, ips are resolved lazily.
+type routeTarget struct {
+	host     string // lower case, without port
+	port     int
+	ips      []net.IP
+	resolved bool
+}
+
+func newRouteTarget(hostPort string) *routeTarget {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	t := &routeTarget{host: strings.ToLower(strings.Trim(host, "[]"))}
+	t.port, _ = strconv.Atoi(port)
+	if ip := net.ParseIP(t.host); ip != nil {
+		t.ips = []net.IP{ip}
+		t.resolved = true
+	}
+	return t
+}
+
+func (t *routeTarget) isIP() bool {
+	return t.resolved && len(t.ips) == 1 && t.ips[0].String() == t.host
+}
+
+// lookup resolves the host locally, once.
+func (t *routeTarget) lookup() []net.IP {
+	if !t.resolved {
+		t.resolved = true
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, t.host)
+		if err != nil {
+			log.WithError(err).Debugln("route lookup", t.host)
+		}
+		for _, a := range addrs {
+			t.ips = append(t.ips, a.IP)
+		}
+	}
+	return t.ips
+}
+
+// Rule is one line of the rules file:
+//
+//	DOMAIN-SUFFIX,google.com,PROXY
+//	IP-CIDR,192.168.0.0/16,DIRECT,no-resolve
+//	GEOIP,CN,DIRECT
+//	RULE-SET,gfwlist,PROXY
+//	MATCH,DIRECT
+type Rule struct {
+	Type      string
+	Value     string
+	Action    Action
+	NoResolve bool // do not resolve domains for ip rules
+
+	match func(r *Router, t *routeTarget) bool
+}
+
+func (rule *Rule) String() string {
+	if rule.Type == "MATCH" {
+		return "MATCH," + rule.Action.String()
+	}
+	s := rule.Type + "," + rule.Value + "," + rule.Action.String()
+	if rule.NoResolve {
+		s += ",no-resolve"
+	}
+	return s
+}
+
+// ips returns the ips an ip rule checks.
+func (rule *Rule) ips(t *routeTarget) []net.IP {
+	if rule.NoResolve && !t.isIP() {
+		return nil
+	}
+	return t.lookup()
+}
+
+type ruleParser func(rule *Rule) error
+
+var ruleParsers = map[string]ruleParser{
+	"DOMAIN": func(rule *Rule) error {
+		v := strings.ToLower(rule.Value)
+		rule.match = func(_ *Router, t *routeTarget) bool { return t.host == v }
+		return nil
+	},
+	"DOMAIN-SUFFIX": func(rule *Rule) error {
+		v := strings.ToLower(strings.TrimPrefix(rule.Value, "."))
+		rule.match = func(_ *Router, t *routeTarget) bool {
+			return t.host == v || strings.HasSuffix(t.host, "."+v)
+		}
+		return nil
+	},
+	"DOMAIN-KEYWORD": func(rule *Rule) error {
+		v := strings.ToLower(rule.Value)
+		rule.match = func(_ *Router, t *routeTarget) bool { return strings.Contains(t.host, v) }
+		return nil
+	},
+	"DOMAIN-REGEX": func(rule *Rule) error {
+		re, err := regexp.Compile(rule.Value)
+		if err != nil {
+			return err
+		}
+		rule.match = func(_ *Router, t *routeTarget) bool { return re.MatchString(t.host) }
+		return nil
+	},
+	"IP-CIDR":  parseCIDR,
+	"IP-CIDR6": parseCIDR,
+	"GEOIP":    parseGeoIP,
+	"RULE-SET": parseRuleSet,
+	"DST-PORT": func(rule *Rule) error {
+		lo, hi, err := parsePortRange(rule.Value)
+		if err != nil {
+			return err
+		}
+		rule.match = func(_ *Router, t *routeTarget) bool { return t.port >= lo && t.port <= hi }
+		return nil
+	},
+	"MATCH": func(rule *Rule) error {
+		rule.match = func(*Router, *routeTarget) bool { return true }
+		return nil
+	},
+}
+
+func parseCIDR(rule *Rule) error {
+	_, ipnet, err := net.ParseCIDR(rule.Value)
+	if err != nil {
+		return err
+	}
+	rule.match = func(_ *Router, t *routeTarget) bool {
+		for _, ip := range rule.ips(t) {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return nil
+}
+
+// parsePortRange parses "443" or "8000-9000".
+func parsePortRange(s string) (lo, hi int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if lo, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, err
+	}
+	hi = lo
+	if len(parts) == 2 {
+		if hi, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if lo < 0 || lo > hi || hi > 65535 {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// ParseRule parses one rule line.
+func ParseRule(line string) (*Rule, error) {
+	parts := strings.Split(line, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	rule := &Rule{Type: strings.ToUpper(parts[0])}
+	if rule.Type == "MATCH" {
+		parts = append([]string{parts[0], ""}, parts[1:]...)
+	}
+	if len(parts) < 3 || len(parts) > 4 {
+		return nil, fmt.Errorf("rule MUST have 3-4 parts: %q", line)
+	}
+	parse, ok := ruleParsers[rule.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown rule type %q", parts[0])
+	}
+	rule.Value = parts[1]
+	var err error
+	if rule.Action, err = ParseAction(parts[2]); err != nil {
+		return nil, err
+	}
+	if len(parts) == 4 {
+		if parts[3] != "no-resolve" {
+			return nil, fmt.Errorf("unknown rule option %q", parts[3])
+		}
+		rule.NoResolve = true
+	}
+	if err = parse(rule); err != nil {
+		return nil, fmt.Errorf("rule %q: %v", line, err)
+	}
+	return rule, nil
+}
+
+// ParseRules parses rule lines, empty lines and # comments are skipped.
+func ParseRules(r io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// Router decides by first matched rule, PROXY if none matched.
+type Router struct {
+	File  string
+	GeoIP *GeoIP              // used by GEOIP rules
+	Sets  map[string]*RuleSet // used by RULE-SET rules
+
+	mu      sync.RWMutex
+	rules   []*Rule
+	checked bool
+}
+
+// NewRouter loads rules from file.
+func NewRouter(file string) (*Router, error) {
+	r := &Router{File: file}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reloads rules from File, they are checked like by Check once it
+// passed.
+func (r *Router) Reload() error {
+	f, err := os.Open(r.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := ParseRules(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", r.File, err)
+	}
+	r.mu.RLock()
+	checked := r.checked
+	r.mu.RUnlock()
+	if checked {
+		if err = r.check(rules); err != nil {
+			return fmt.Errorf("%s: %v", r.File, err)
+		}
+	}
+	r.SetRules(rules)
+	return nil
+}
+
+// Check returns an error if a RULE-SET rule names a set not in Sets, or a
+// GEOIP rule has no GeoIP database. It is called once Sets and GeoIP are
+// set, later reloads are checked too.
+func (r *Router) Check() error {
+	if err := r.check(r.Rules()); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.checked = true
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Router) check(rules []*Rule) error {
+	for _, rule := range rules {
+		switch rule.Type {
+		case "RULE-SET":
+			if _, ok := r.Sets[rule.Value]; !ok {
+				return fmt.Errorf("no rule set %q", rule.Value)
+			}
+		case "GEOIP":
+			if r.GeoIP == nil {
+				return fmt.Errorf("%s: no GeoIP database", rule)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Router) SetRules(rules []*Rule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+}
+
+func (r *Router) Rules() []*Rule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rules
+}
+
+// Route returns the action for target host:port and the matched rule, nil
+// rule if none matched.
+func (r *Router) Route(target string) (Action, *Rule) {
+	if r == nil {
+		return PROXY, nil
+	}
+	t := newRouteTarget(target)
+	for _, rule := range r.Rules() {
+		if rule.match(r, t) {
+			return rule.Action, rule
+		}
+	}
+	return PROXY, nil
+}
+
+// openStream opens a raw byte stream to target, through the server or
+// directly. up is the data from the local client.
+func (client *Client) openStream(ctx context.Context, action Action, isConnect bool, target string, up io.Reader) (io.ReadCloser, *ProxyError) {
+	if action == DIRECT {
+		return dialDirect(ctx, target, up)
+	}
+	if pe := client.refusedError(); pe != nil {
+		return nil, pe
+	}
+
+	if !isConnect {
+		res, pe := client.roundTripReverse(ctx, target, up)
+		if pe != nil {
+			return nil, pe
+		}
+		return res.Body, nil
+	}
+
+	req := client.newConnectRequest(target).WithContext(ctx)
+	req.Body = ioutil.NopCloser(up)
+	res, err := client.h2Transport.RoundTrip(req)
+	if err != nil {
+		return nil, errorFromRoundTrip(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		// Close waits for the body writer, which reads up until the local
+		// conn is closed after the error response.
+		go res.Body.Close()
+		return nil, errorFromStatus(res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+func dialDirect(ctx context.Context, target string, up io.Reader) (io.ReadCloser, *ProxyError) {
+	d := net.Dialer{Timeout: directDialTimeout}
+	rc, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, errorFromRoundTrip(err)
+	}
+	go func() {
+		<-ctx.Done()
+		rc.Close()
+	}()
+	go func() {
+		io.Copy(rc, up)
+		if tc, ok := rc.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	return rc, nil
+}
+
+// directRequest re-encodes one request with Connection: close, so the
+// destination closes after the response.
+func directRequest(r *bufio.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		req.Close = true
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		pw.CloseWithError(req.Write(pw))
+	}()
+	return pr
+}
+
+func rejectError(rule *Rule) *ProxyError {
+	if rule == nil {
+		return newProxyError(http.StatusForbidden, PS_HTTP_REQUEST_DENIED, "blocked")
+	}
+	return newProxyError(http.StatusForbidden, PS_HTTP_REQUEST_DENIED, "blocked by rule "+rule.String())
+}
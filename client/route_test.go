@@ -0,0 +1,124 @@
+package client
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in     string
+		lo, hi int
+		ok     bool
+	}{
+		{"443", 443, 443, true},
+		{"8000-9000", 8000, 9000, true},
+		{"0-65535", 0, 65535, true},
+		{"9000-8000", 0, 0, false},
+		{"-1", 0, 0, false},
+		{"65536", 0, 0, false},
+		{"80-65536", 0, 0, false},
+		{"http", 0, 0, false},
+		{"80-", 0, 0, false},
+	}
+	for _, tt := range tests {
+		lo, hi, err := parsePortRange(tt.in)
+		if (err == nil) != tt.ok || lo != tt.lo || hi != tt.hi {
+			t.Errorf("parsePortRange(%q) = %d, %d, %v", tt.in, lo, hi, err)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // String of the rule, empty if it fails
+	}{
+		{"DOMAIN-SUFFIX,google.com,PROXY", "DOMAIN-SUFFIX,google.com,PROXY"},
+		{"domain, Example.com , direct", "DOMAIN,Example.com,DIRECT"},
+		{"IP-CIDR,192.168.0.0/16,DIRECT,no-resolve", "IP-CIDR,192.168.0.0/16,DIRECT,no-resolve"},
+		{"DST-PORT,8000-9000,REJECT", "DST-PORT,8000-9000,REJECT"},
+		{"MATCH,DIRECT", "MATCH,DIRECT"},
+		{"DST-PORT,9000-8000,REJECT", ""},
+		{"IP-CIDR,192.168.0.0/33,DIRECT", ""},
+		{"DOMAIN-REGEX,(,PROXY", ""},
+		{"DOMAIN,example.com", ""},
+		{"DOMAIN,example.com,DROP", ""},
+		{"DOMAIN,example.com,PROXY,resolve", ""},
+		{"HOST,example.com,PROXY", ""},
+	}
+	for _, tt := range tests {
+		rule, err := ParseRule(tt.line)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("ParseRule(%q) = %s, want an error", tt.line, rule)
+		case tt.want != "" && err != nil:
+			t.Errorf("ParseRule(%q): %v", tt.line, err)
+		case tt.want != "" && rule.String() != tt.want:
+			t.Errorf("ParseRule(%q) = %s, want %s", tt.line, rule, tt.want)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# comment
+DOMAIN-SUFFIX,example.com,DIRECT
+DOMAIN-KEYWORD,ads,REJECT
+IP-CIDR,10.0.0.0/8,DIRECT,no-resolve
+DST-PORT,25,REJECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Router{}
+	r.SetRules(rules)
+	tests := []struct {
+		target string
+		want   Action
+	}{
+		{"www.example.com:443", DIRECT},
+		{"example.com:80", DIRECT},
+		{"notexample.com:80", PROXY},
+		{"ads.test:443", REJECT},
+		{"10.1.2.3:22", DIRECT},
+		{"[2001:db8::1]:25", REJECT},
+		{"other.test:443", PROXY},
+	}
+	for _, tt := range tests {
+		if got, _ := r.Route(tt.target); got != tt.want {
+			t.Errorf("Route(%s) = %s, want %s", tt.target, got, tt.want)
+		}
+	}
+	if pe := rejectError(nil); pe.Status != 403 {
+		t.Errorf("rejectError(nil) = %v", pe)
+	}
+}
+
+func TestRouterCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules")
+	if err := ioutil.WriteFile(file, []byte("DOMAIN,example.com,DIRECT\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRouter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rules := range []string{"GEOIP,CN,DIRECT\n", "RULE-SET,gfwlist,PROXY\n"} {
+		if err = ioutil.WriteFile(file, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = r.Reload(); err == nil {
+			t.Errorf("reloaded %q without a database", rules)
+		}
+	}
+	if got := r.Rules(); len(got) != 1 || got[0].Type != "DOMAIN" {
+		t.Errorf("rules replaced by failed reloads: %v", got)
+	}
+}
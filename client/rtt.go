@@ -0,0 +1,107 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	rttWindow = 100
+	rttAlpha  = 0.125 // like the srtt of tcp
+	jitterK   = 1.0 / 16
+)
+
+// RTT is the round trip time report of a server, durations in milliseconds.
+type RTT struct {
+	Samples  int       `json:"samples"`
+	Last     float64   `json:"last_ms"`
+	EWMA     float64   `json:"ewma_ms"`
+	Jitter   float64   `json:"jitter_ms"`
+	P50      float64   `json:"p50_ms"`
+	P90      float64   `json:"p90_ms"`
+	P99      float64   `json:"p99_ms"`
+	Missed   int       `json:"missed"` // pongs missed in a row
+	LastPong time.Time `json:"last_pong"`
+	Healthy  bool      `json:"healthy"`
+}
+
+// rttStats keeps an EWMA and a window of the last samples.
+type rttStats struct {
+	mu       sync.Mutex
+	samples  int
+	last     time.Duration
+	ewma     float64
+	jitter   float64
+	window   [rttWindow]time.Duration
+	missed   int
+	lastPong time.Time
+}
+
+func (s *rttStats) add(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.samples == 0 {
+		s.ewma = float64(rtt)
+	} else {
+		s.ewma += rttAlpha * (float64(rtt) - s.ewma)
+		d := float64(rtt - s.last)
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += jitterK * (d - s.jitter)
+	}
+	s.window[s.samples%rttWindow] = rtt
+	s.samples++
+	s.last = rtt
+	s.missed = 0
+	s.lastPong = time.Now()
+}
+
+func (s *rttStats) miss() {
+	s.mu.Lock()
+	s.missed++
+	s.mu.Unlock()
+}
+
+// reset clears the missed count of a new connection.
+func (s *rttStats) reset() {
+	s.mu.Lock()
+	s.missed = 0
+	s.mu.Unlock()
+}
+
+func (s *rttStats) report() RTT {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := RTT{
+		Samples:  s.samples,
+		Last:     ms(float64(s.last)),
+		EWMA:     ms(s.ewma),
+		Jitter:   ms(s.jitter),
+		Missed:   s.missed,
+		LastPong: s.lastPong,
+		Healthy:  s.samples > 0 && s.missed == 0,
+	}
+	n := s.samples
+	if n > rttWindow {
+		n = rttWindow
+	}
+	if n > 0 {
+		w := append([]time.Duration(nil), s.window[:n]...)
+		sort.Slice(w, func(i, j int) bool { return w[i] < w[j] })
+		r.P50 = ms(float64(w[n*50/100]))
+		r.P90 = ms(float64(w[n*90/100]))
+		r.P99 = ms(float64(w[n*99/100]))
+	}
+	return r
+}
+
+func ms(ns float64) float64 {
+	return ns / float64(time.Millisecond)
+}
+
+// RTT reports the round trip time to the server.
+func (client *Client) RTT() RTT {
+	return client.rtt.report()
+}
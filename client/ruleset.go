@@ -0,0 +1,264 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// domainTrie matches a host and all its sub domains, labels are stored from
+// the top level domain down.
+type domainTrie struct {
+	children map[string]*domainTrie
+	end      bool
+}
+
+func (t *domainTrie) insert(domain string) {
+	labels := strings.Split(strings.ToLower(strings.Trim(domain, ".")), ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*domainTrie)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = new(domainTrie)
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.end = true
+}
+
+// match reports whether host or any parent domain of host was inserted.
+func (t *domainTrie) match(host string) bool {
+	node := t
+	for end := len(host); end > 0; {
+		start := strings.LastIndexByte(host[:end], '.') + 1
+		child, ok := node.children[host[start:end]]
+		if !ok {
+			return false
+		}
+		if child.end {
+			return true
+		}
+		node = child
+		end = start - 1
+	}
+	return false
+}
+
+// walk calls fn with every inserted domain, sub domains of an inserted
+// domain are skipped.
+func (t *domainTrie) walk(suffix string, fn func(domain string)) {
+	if t.end {
+		fn(suffix)
+		return
+	}
+	for label, child := range t.children {
+		domain := label
+		if suffix != "" {
+			domain += "." + suffix
+		}
+		child.walk(domain, fn)
+	}
+}
+
+func (t *domainTrie) domains() []string {
+	var ds []string
+	t.walk("", func(d string) { ds = append(ds, d) })
+	sort.Strings(ds)
+	return ds
+}
+
+// RuleSet is a domain list in gfwlist (base64 Adblock Plus) or plain domain
+// format, loaded from a local file or an url fetched through the tunnel.
+type RuleSet struct {
+	Name   string
+	Source string
+	Client *http.Client // fetches http(s) sources
+
+	mu         sync.RWMutex
+	domains    *domainTrie
+	exclusions *domainTrie // @@ rules of gfwlist
+}
+
+// Load fetches and compiles Source.
+func (rs *RuleSet) Load() error {
+	body, err := rs.fetch()
+	if err != nil {
+		return fmt.Errorf("rule set %s: %v", rs.Name, err)
+	}
+	domains, exclusions, skipped := parseRuleList(body)
+	rs.mu.Lock()
+	rs.domains, rs.exclusions = domains, exclusions
+	rs.mu.Unlock()
+	log.WithField("source", rs.Source).Infof("rule set %s loaded, %d rules skipped", rs.Name, skipped)
+	return nil
+}
+
+func (rs *RuleSet) fetch() ([]byte, error) {
+	u, err := url.Parse(rs.Source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ioutil.ReadFile(rs.Source)
+	}
+	c := rs.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	res, err := c.Get(rs.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", rs.Source, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// Match reports whether host is in the list and not excluded.
+func (rs *RuleSet) Match(host string) bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	if rs.domains == nil || rs.exclusions.match(host) {
+		return false
+	}
+	return rs.domains.match(host)
+}
+
+// parseRuleList detects the format: base64 encoded or plain gfwlist, or one
+// domain per line.
+func parseRuleList(body []byte) (domains, exclusions *domainTrie, skipped int) {
+	trimmed := bytes.TrimSpace(body)
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(trimmed), nil))); err == nil {
+		body = decoded
+	}
+
+	domains, exclusions = new(domainTrie), new(domainTrie)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+		trie := domains
+		if strings.HasPrefix(line, "@@") {
+			trie = exclusions
+			line = line[2:]
+		}
+		if host := adblockHost(line); host != "" {
+			trie.insert(host)
+		} else {
+			skipped++
+		}
+	}
+	return
+}
+
+// adblockHost extracts the domain of an Adblock Plus rule, empty if the rule
+// can not be expressed as a domain suffix (regexp, wildcard, path only).
+func adblockHost(line string) string {
+	switch {
+	case strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/"):
+		return ""
+	case strings.HasPrefix(line, "||"):
+		line = line[2:]
+	case strings.HasPrefix(line, "|"):
+		line = line[1:]
+	}
+	if i := strings.Index(line, "://"); i >= 0 {
+		line = line[i+3:]
+	}
+	line = strings.TrimPrefix(line, ".")
+	if i := strings.IndexAny(line, "/^:$"); i >= 0 {
+		line = line[:i]
+	}
+	if line == "" || strings.ContainsAny(line, "*%?|") || !strings.Contains(line, ".") {
+		return ""
+	}
+	return strings.ToLower(line)
+}
+
+// RULE-SET,gfwlist,PROXY matches hosts in the named rule set.
+func parseRuleSet(rule *Rule) error {
+	name := rule.Value
+	rule.match = func(r *Router, t *routeTarget) bool {
+		rs, ok := r.Sets[name]
+		return ok && rs.Match(t.host)
+	}
+	return nil
+}
+
+var pacGenTpl = template.Must(template.New("pac").Parse(`var proxy = "PROXY {{"{{"}}.{{"}}"}}; DIRECT";
+var domains = {{.Domains}};
+var exclusions = {{.Exclusions}};
+
+function match(set, host) {
+	for (;;) {
+		if (set.hasOwnProperty(host)) {
+			return true;
+		}
+		var i = host.indexOf(".");
+		if (i < 0) {
+			return false;
+		}
+		host = host.substring(i + 1);
+	}
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (match(exclusions, host)) {
+		return "DIRECT";
+	}
+	if (match(domains, host)) {
+		return proxy;
+	}
+	return "DIRECT";
+}
+`))
+
+// GeneratePac compiles rule sets into a pac template. Matched hosts go to
+// the proxy, the template takes the local proxy address like the server pac.
+func GeneratePac(sets ...*RuleSet) (*template.Template, error) {
+	domains, exclusions := make(map[string]int), make(map[string]int)
+	for _, rs := range sets {
+		rs.mu.RLock()
+		if rs.domains != nil {
+			for _, d := range rs.domains.domains() {
+				domains[d] = 1
+			}
+			for _, d := range rs.exclusions.domains() {
+				exclusions[d] = 1
+			}
+		}
+		rs.mu.RUnlock()
+	}
+	d, err := json.Marshal(domains)
+	if err != nil {
+		return nil, err
+	}
+	e, err := json.Marshal(exclusions)
+	if err != nil {
+		return nil, err
+	}
+
+	var script bytes.Buffer
+	if err = pacGenTpl.Execute(&script, map[string]string{
+		"Domains":    string(d),
+		"Exclusions": string(e),
+	}); err != nil {
+		return nil, err
+	}
+	return template.New("pac").Parse(script.String())
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestAdblockHost(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"||google.com", "google.com"},
+		{"||Example.COM^", "example.com"},
+		{"|https://www.example.com/path", "www.example.com"},
+		{".example.org", "example.org"},
+		{"example.net:8080", "example.net"},
+		{"http://example.io/a?b", "example.io"},
+		{"/^https?:\\/\\/[^\\/]+example\\.com/", ""},
+		{"*.example.com", ""},
+		{"||example*.com", ""},
+		{"localhost", ""},
+		{"/path/only", ""},
+	}
+	for _, tt := range tests {
+		if got := adblockHost(tt.line); got != tt.want {
+			t.Errorf("adblockHost(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleList(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! comment
+# comment
+||google.com
+.twitter.com
+@@||cn.google.com
+/regexp/
+*.wildcard
+`
+	for _, body := range []string{list, base64.StdEncoding.EncodeToString([]byte(list))} {
+		domains, exclusions, skipped := parseRuleList([]byte(body))
+		if got, want := domains.domains(), []string{"google.com", "twitter.com"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("domains %v, want %v", got, want)
+		}
+		if got, want := exclusions.domains(), []string{"cn.google.com"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("exclusions %v, want %v", got, want)
+		}
+		if skipped != 2 {
+			t.Errorf("skipped %d, want 2", skipped)
+		}
+	}
+}
+
+func TestDomainTrie(t *testing.T) {
+	trie := new(domainTrie)
+	for _, d := range []string{"example.com", "a.b.example.org", ".Upper.NET."} {
+		trie.insert(d)
+	}
+	// a sub domain of an inserted domain is not walked
+	trie.insert("www.example.com")
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"notexample.com", false},
+		{"com", false},
+		{"b.example.org", false},
+		{"x.a.b.example.org", true},
+		{"upper.net", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := trie.match(tt.host); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	if got, want := trie.domains(), []string{"a.b.example.org", "example.com", "upper.net"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("domains %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,356 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth in bytes per second, zero means unlimited. Burst defaults to one
+// second of traffic, larger reads wait for the tokens in bursts.
+type Bandwidth struct {
+	Up    int `json:"up"`
+	Down  int `json:"down"`
+	Burst int `json:"burst,omitempty"`
+}
+
+type HostBandwidth struct {
+	Pattern string `json:"pattern"` // path.Match pattern of the destination host
+	Bandwidth
+}
+
+// ShaperConfig is the json config of a Shaper.
+type ShaperConfig struct {
+	Global    Bandwidth            `json:"global"`
+	Listeners map[string]Bandwidth `json:"listeners"` // by port
+	PerIP     Bandwidth            `json:"per_ip"`
+	Hosts     []HostBandwidth      `json:"hosts"` // first match
+}
+
+func LoadShaperConfig(name string) (*ShaperConfig, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg ShaperConfig
+	if err = json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ipIdle is how long the buckets of a client ip are kept after its last use.
+const ipIdle = 10 * time.Minute
+
+// buckets is an upload and a download token bucket.
+type buckets struct {
+	up      *rate.Limiter
+	down    *rate.Limiter
+	used    int64 // unix nano of the last use
+	streams int32 // open streams of a client ip
+}
+
+func (b *buckets) touch() {
+	atomic.StoreInt64(&b.used, time.Now().UnixNano())
+}
+
+// idle reports whether no stream holds b and it was not used for ipIdle.
+func (b *buckets) idle(now time.Time) bool {
+	return atomic.LoadInt32(&b.streams) == 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&b.used))) > ipIdle
+}
+
+func newBuckets(bw Bandwidth) *buckets {
+	b := &buckets{
+		up:   rate.NewLimiter(rate.Inf, 0),
+		down: rate.NewLimiter(rate.Inf, 0),
+	}
+	b.set(bw)
+	return b
+}
+
+func (b *buckets) set(bw Bandwidth) {
+	setLimit(b.up, bw.Up, bw.Burst)
+	setLimit(b.down, bw.Down, bw.Burst)
+}
+
+func setLimit(l *rate.Limiter, bytesPerSec, burst int) {
+	if bytesPerSec <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	l.SetBurst(burst)
+	l.SetLimit(rate.Limit(bytesPerSec))
+}
+
+type hostBuckets struct {
+	pattern string
+	*buckets
+}
+
+// Shaper limits bandwidth globally, per listener, per client ip and per
+// destination host. Limits can be changed while streams are running.
+type Shaper struct {
+	mu        sync.RWMutex
+	cfg       ShaperConfig
+	global    *buckets
+	listeners map[string]*buckets
+	ips       map[string]*buckets
+	hosts     []hostBuckets
+	swept     time.Time
+}
+
+func NewShaper(cfg *ShaperConfig) *Shaper {
+	s := &Shaper{
+		global:    newBuckets(Bandwidth{}),
+		listeners: make(map[string]*buckets),
+		ips:       make(map[string]*buckets),
+	}
+	if cfg != nil {
+		s.Reload(cfg)
+	}
+	return s
+}
+
+// Reload replaces all limits with cfg, listeners missing from cfg become
+// unlimited.
+func (s *Shaper) Reload(cfg *ShaperConfig) {
+	s.SetGlobal(cfg.Global)
+	s.SetPerIP(cfg.PerIP)
+	s.mu.Lock()
+	for port, b := range s.listeners {
+		if _, ok := cfg.Listeners[port]; !ok {
+			b.set(Bandwidth{})
+			delete(s.listeners, port)
+			delete(s.cfg.Listeners, port)
+		}
+	}
+	s.mu.Unlock()
+	for port, bw := range cfg.Listeners {
+		s.SetListener(port, bw)
+	}
+	s.SetHosts(cfg.Hosts)
+}
+
+// Config returns a copy of current limits.
+func (s *Shaper) Config() ShaperConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cfg := s.cfg
+	cfg.Listeners = make(map[string]Bandwidth, len(s.cfg.Listeners))
+	for port, bw := range s.cfg.Listeners {
+		cfg.Listeners[port] = bw
+	}
+	cfg.Hosts = append([]HostBandwidth(nil), s.cfg.Hosts...)
+	return cfg
+}
+
+func (s *Shaper) SetGlobal(bw Bandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.Global = bw
+	s.global.set(bw)
+}
+
+func (s *Shaper) SetListener(port string, bw Bandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.Listeners == nil {
+		s.cfg.Listeners = make(map[string]Bandwidth)
+	}
+	s.cfg.Listeners[port] = bw
+	if b, ok := s.listeners[port]; ok {
+		b.set(bw)
+	} else {
+		s.listeners[port] = newBuckets(bw)
+	}
+}
+
+// SetPerIP sets the limit every client ip gets.
+func (s *Shaper) SetPerIP(bw Bandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.PerIP = bw
+	for _, b := range s.ips {
+		b.set(bw)
+	}
+}
+
+func (s *Shaper) SetHosts(hosts []HostBandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.Hosts = append([]HostBandwidth(nil), hosts...)
+
+	old := make(map[string]*buckets, len(s.hosts))
+	for _, hb := range s.hosts {
+		old[hb.pattern] = hb.buckets
+	}
+	s.hosts = s.hosts[:0]
+	for _, h := range hosts {
+		b, ok := old[h.Pattern]
+		if ok {
+			b.set(h.Bandwidth)
+			delete(old, h.Pattern)
+		} else {
+			b = newBuckets(h.Bandwidth)
+		}
+		s.hosts = append(s.hosts, hostBuckets{h.Pattern, b})
+	}
+	// running streams of removed patterns are no longer limited
+	for _, b := range old {
+		b.set(Bandwidth{})
+	}
+}
+
+// Stream returns the buckets a stream from ip to host on listener port
+// must pass, waiting for tokens stops when ctx is done.
+func (s *Shaper) Stream(ctx context.Context, port, ip, host string) *StreamShape {
+	if s == nil {
+		return nil
+	}
+	host = hostNoPort(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepIPs()
+	ss := &StreamShape{ctx: ctx, bs: []*buckets{s.global}}
+	if b, ok := s.listeners[port]; ok {
+		ss.bs = append(ss.bs, b)
+	}
+	if ip != "" {
+		b, ok := s.ips[ip]
+		if !ok {
+			b = newBuckets(s.cfg.PerIP)
+			s.ips[ip] = b
+		}
+		b.touch()
+		atomic.AddInt32(&b.streams, 1)
+		ss.ip = b
+		ss.bs = append(ss.bs, b)
+	}
+	for _, hb := range s.hosts {
+		if ok, _ := path.Match(hb.pattern, host); ok {
+			ss.bs = append(ss.bs, hb.buckets)
+			break
+		}
+	}
+	return ss
+}
+
+// sweepIPs drops the buckets of client ips without open streams and idle
+// for ipIdle, at most once per minute. The caller holds s.mu.
+func (s *Shaper) sweepIPs() {
+	now := time.Now()
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for ip, b := range s.ips {
+		if b.idle(now) {
+			delete(s.ips, ip)
+		}
+	}
+}
+
+// StreamShape shapes one stream, a nil StreamShape does nothing.
+type StreamShape struct {
+	ctx    context.Context
+	bs     []*buckets
+	ip     *buckets // of the client ip, kept until Close
+	closed int32
+}
+
+// Close releases the buckets of the client ip, they can be swept after it.
+func (ss *StreamShape) Close() {
+	if ss != nil && ss.ip != nil && atomic.CompareAndSwapInt32(&ss.closed, 0, 1) {
+		atomic.AddInt32(&ss.ip.streams, -1)
+	}
+}
+
+func (ss *StreamShape) WaitUp(n int) error {
+	if ss == nil {
+		return nil
+	}
+	if ss.ip != nil {
+		ss.ip.touch()
+	}
+	for _, b := range ss.bs {
+		if err := waitN(ss.ctx, b.up, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *StreamShape) WaitDown(n int) error {
+	if ss == nil {
+		return nil
+	}
+	if ss.ip != nil {
+		ss.ip.touch()
+	}
+	for _, b := range ss.bs {
+		if err := waitN(ss.ctx, b.down, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitN(ctx context.Context, l *rate.Limiter, n int) error {
+	if l.Limit() == rate.Inf {
+		return nil
+	}
+	for n > 0 {
+		chunk := n
+		if burst := l.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// UpReader shapes data read from the local client.
+func (ss *StreamShape) UpReader(r io.Reader) io.Reader {
+	if ss == nil {
+		return r
+	}
+	return &shapedReader{r, ss.WaitUp}
+}
+
+// DownReader shapes data read from the server.
+func (ss *StreamShape) DownReader(r io.Reader) io.Reader {
+	if ss == nil {
+		return r
+	}
+	return &shapedReader{r, ss.WaitDown}
+}
+
+type shapedReader struct {
+	r    io.Reader
+	wait func(n int) error
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.wait(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
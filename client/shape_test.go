@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSweepIPsKeepsOpenStreams(t *testing.T) {
+	s := NewShaper(&ShaperConfig{PerIP: Bandwidth{Up: 1000, Down: 1000}})
+	ss := s.Stream(context.Background(), "1080", "10.0.0.1", "example.com:443")
+	ss.ip.used = time.Now().Add(-2 * ipIdle).UnixNano()
+
+	sweep := func() {
+		s.mu.Lock()
+		s.swept = time.Time{}
+		s.sweepIPs()
+		s.mu.Unlock()
+	}
+	sweep()
+	if _, ok := s.ips["10.0.0.1"]; !ok {
+		t.Fatal("swept the buckets of an open stream")
+	}
+
+	ss.Close()
+	ss.Close()
+	sweep()
+	if _, ok := s.ips["10.0.0.1"]; ok {
+		t.Fatal("kept the buckets of a closed idle ip")
+	}
+}
+
+func TestSetLimitBurst(t *testing.T) {
+	b := newBuckets(Bandwidth{Up: 1000})
+	if got := b.up.Burst(); got != 1000 {
+		t.Errorf("burst %d, want one second of traffic", got)
+	}
+	ss := &StreamShape{ctx: context.Background(), bs: []*buckets{b}}
+	start := time.Now()
+	if err := ss.WaitUp(1500); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("1500 bytes at 1000/s passed in %v", d)
+	}
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const recentErrorsSize = 100
+
+var (
+	lastStreamID uint64
+	lastTunnelID uint64
+
+	recentErrors = &errorRing{}
+)
+
+func init() {
+	log.Hooks.Add(recentErrors)
+}
+
+// Stream is a snapshot of an active stream of a listener.
+type Stream struct {
+	ID      uint64    `json:"id"`
+	Port    string    `json:"port"`
+	Remote  string    `json:"remote"`
+	User    string    `json:"user,omitempty"`
+	Target  string    `json:"target"`
+	Action  string    `json:"action"`
+	Started time.Time `json:"started"`
+	Age     string    `json:"age"`
+	Traffic Traffic   `json:"traffic"`
+}
+
+type activeStream struct {
+	Stream
+	count  *streamCount
+	cancel func()
+}
+
+// Tunnel is a connection to the server which carries the h2 streams.
+type Tunnel struct {
+	ID     uint64    `json:"id"`
+	Addr   string    `json:"addr"`
+	Scheme string    `json:"scheme"`
+	Dialed time.Time `json:"dialed"`
+	LastOK time.Time `json:"last_ok"` // last answered HOST_OK ping
+
+	conn io.Closer
+}
+
+// ListenerStatus is the state of one listener and its server.
+type ListenerStatus struct {
+	Port       string      `json:"port"`
+	Server     string      `json:"server"`
+	Tunnels    []Tunnel    `json:"tunnels"`
+	Streams    int         `json:"streams"`
+	RTT        RTT         `json:"rtt"`
+	ServerInfo *ServerInfo `json:"server_info,omitempty"`
+}
+
+// track registers an active stream until the returned func is called,
+// cancel must abort the stream.
+func (client *Client) track(remote, user, target string, action Action, count *streamCount, cancel func()) func() {
+	st := &activeStream{
+		Stream: Stream{
+			ID:      atomic.AddUint64(&lastStreamID, 1),
+			Port:    client.Port,
+			Remote:  remote,
+			User:    user,
+			Target:  target,
+			Action:  action.String(),
+			Started: time.Now(),
+		},
+		count:  count,
+		cancel: cancel,
+	}
+	client.muStatus.Lock()
+	if client.streams == nil {
+		client.streams = make(map[uint64]*activeStream)
+	}
+	client.streams[st.ID] = st
+	client.muStatus.Unlock()
+	activeStreams.WithLabelValues(client.Port).Inc()
+	return func() {
+		client.muStatus.Lock()
+		delete(client.streams, st.ID)
+		client.muStatus.Unlock()
+		activeStreams.WithLabelValues(client.Port).Dec()
+		count.flush()
+		t := count.Traffic()
+		streamBytes.WithLabelValues(client.Port, "up").Add(float64(t.Up))
+		streamBytes.WithLabelValues(client.Port, "down").Add(float64(t.Down))
+	}
+}
+
+// Streams returns the active streams ordered by id.
+func (client *Client) Streams() []Stream {
+	now := time.Now()
+	client.muStatus.Lock()
+	streams := make([]Stream, 0, len(client.streams))
+	for _, st := range client.streams {
+		s := st.Stream
+		s.Age = now.Sub(s.Started).Truncate(time.Second).String()
+		s.Traffic = st.count.Traffic()
+		streams = append(streams, s)
+	}
+	client.muStatus.Unlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+	return streams
+}
+
+// CloseStream aborts the active stream of id.
+func (client *Client) CloseStream(id uint64) bool {
+	client.muStatus.Lock()
+	st, ok := client.streams[id]
+	client.muStatus.Unlock()
+	if ok {
+		st.cancel()
+	}
+	return ok
+}
+
+func (client *Client) addTunnel(conn io.Closer, addr string) uint64 {
+	t := &Tunnel{
+		ID:     atomic.AddUint64(&lastTunnelID, 1),
+		Addr:   addr,
+		Scheme: client.ServerUrl.Scheme,
+		Dialed: time.Now(),
+		conn:   conn,
+	}
+	client.muStatus.Lock()
+	if client.tunnels == nil {
+		client.tunnels = make(map[uint64]*Tunnel)
+	}
+	client.tunnels[t.ID] = t
+	client.muStatus.Unlock()
+	h2Conns.WithLabelValues(client.Port).Inc()
+	return t.ID
+}
+
+func (client *Client) tunnelOK(id uint64) {
+	client.muStatus.Lock()
+	if t, ok := client.tunnels[id]; ok {
+		t.LastOK = time.Now()
+	}
+	client.muStatus.Unlock()
+}
+
+func (client *Client) removeTunnel(id uint64) {
+	client.muStatus.Lock()
+	_, ok := client.tunnels[id]
+	delete(client.tunnels, id)
+	client.muStatus.Unlock()
+	if ok {
+		h2Conns.WithLabelValues(client.Port).Dec()
+	}
+}
+
+// Reconnect closes all connections to the server, new streams dial again.
+func (client *Client) Reconnect() {
+	client.muStatus.Lock()
+	conns := make([]io.Closer, 0, len(client.tunnels))
+	for _, t := range client.tunnels {
+		conns = append(conns, t.conn)
+	}
+	client.muStatus.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	log.WithField("port", client.Port).Infoln("reconnect, closed", len(conns), "conns")
+}
+
+// Status returns the state of the listener.
+func (client *Client) Status() ListenerStatus {
+	status := ListenerStatus{
+		Port:   client.Port,
+		Server: client.ServerUrl.String(),
+		RTT:    client.RTT(),
+	}
+	status.ServerInfo = client.ServerInfo()
+
+	client.muStatus.Lock()
+	status.Streams = len(client.streams)
+	status.Tunnels = make([]Tunnel, 0, len(client.tunnels))
+	for _, t := range client.tunnels {
+		status.Tunnels = append(status.Tunnels, *t)
+	}
+	client.muStatus.Unlock()
+	sort.Slice(status.Tunnels, func(i, j int) bool { return status.Tunnels[i].ID < status.Tunnels[j].ID })
+	return status
+}
+
+// LogEntry is a logged error.
+type LogEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// errorRing is a logrus hook keeping the last errors of the package.
+type errorRing struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+}
+
+func (r *errorRing) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (r *errorRing) Fire(entry *logrus.Entry) error {
+	e := LogEntry{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	if len(entry.Data) > 0 {
+		e.Fields = make(map[string]string, len(entry.Data))
+		for k, v := range entry.Data {
+			e.Fields[k] = fmt.Sprint(v)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < recentErrorsSize {
+		r.entries = append(r.entries, e)
+	} else {
+		r.entries[r.next] = e
+	}
+	r.next = (r.next + 1) % recentErrorsSize
+	return nil
+}
+
+// RecentErrors returns the last logged errors, oldest first.
+func RecentErrors() []LogEntry {
+	r := recentErrors
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < recentErrorsSize {
+		return append([]LogEntry{}, r.entries...)
+	}
+	return append(append([]LogEntry(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package client
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog writes to the local syslog daemon, or the unix socket if set.
+func openSyslog(socket string) (io.Writer, error) {
+	if socket == "" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "wsh")
+	}
+	return syslog.Dial("unixgram", socket, syslog.LOG_INFO|syslog.LOG_DAEMON, "wsh")
+}
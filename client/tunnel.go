@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DialTunnel opens a tcp connection to addr through the server.
+func (client *Client) DialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	down, pe := client.openStream(ctx, PROXY, true, addr, pr)
+	if pe != nil {
+		pw.Close()
+		return nil, pe
+	}
+	return &tunnelConn{
+		ReadCloser: down,
+		w:          pw,
+		local:      tunnelAddr("wsh:" + client.Port),
+		remote:     tunnelAddr(addr),
+	}, nil
+}
+
+// HTTPClient returns a http.Client that connects through the server.
+func (client *Client) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         client.DialTunnel,
+			TLSHandshakeTimeout: 30 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: 2 * time.Minute,
+	}
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "wsh" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelConn is a CONNECT stream as net.Conn, deadlines are not supported.
+type tunnelConn struct {
+	io.ReadCloser
+	w      *io.PipeWriter
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *tunnelConn) Close() error {
+	c.w.Close()
+	return c.ReadCloser.Close()
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr                { return c.local }
+func (c *tunnelConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *tunnelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *tunnelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error { return nil }
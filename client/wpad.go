@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// pacPaths are served by the listener, /wpad.dat for WPAD discovery.
+var pacPaths = map[string]bool{
+	"/pac":       true,
+	"/wpad.dat":  true,
+	"/proxy.pac": true,
+}
+
+// servePac writes the pac executed with the local address as a complete
+// HTTP/1.1 response, with ETag and Cache-Control headers.
+func (client *Client) servePac(c net.Conn, bufConn *bufio.Reader) {
+	localAddr := c.LocalAddr().String()
+	req, err := http.ReadRequest(bufConn)
+	if err != nil {
+		newProxyError(http.StatusBadRequest, PS_HTTP_REQUEST_ERROR, "bad pac request: "+err.Error()).Write(c)
+		return
+	}
+
+	var body bytes.Buffer
+	if err = client.Pac().Execute(&body, localAddr); err != nil {
+		log.WithError(err).WithField("LocalAddr", localAddr).Errorln("Exec pac")
+		newProxyError(http.StatusInternalServerError, PS_PROXY_INTERNAL_ERROR, "exec pac: "+err.Error()).Write(c)
+		return
+	}
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	res := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+	}
+	res.Header.Set("Content-Type", pacContentType)
+	res.Header.Set("ETag", etag)
+	if client.PacMaxAge > 0 {
+		res.Header.Set("Cache-Control", "max-age="+strconv.Itoa(int(client.PacMaxAge.Seconds())))
+	} else {
+		res.Header.Set("Cache-Control", "no-cache")
+	}
+
+	res.Request = req // no body for HEAD
+	if req.Header.Get("If-None-Match") == etag {
+		res.StatusCode = http.StatusNotModified
+		res.ContentLength = 0
+	} else {
+		res.Body = ioutil.NopCloser(&body)
+	}
+	if err = res.Write(c); err != nil {
+		log.WithError(err).Debugln("write pac")
+	}
+}
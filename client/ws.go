@@ -3,26 +3,33 @@ package client
 import (
 	"io"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 func NewWs(ws *websocket.Conn, bufSize int, pingPeriod time.Duration) *Ws {
+	w := &Ws{
+		Conn:       ws,
+		pingPeriod: pingPeriod,
+		copyBuf:    make([]byte, bufSize),
+	}
 	ws.SetPongHandler(func(msg string) error {
 		sent, err := strconv.ParseInt(msg, 36, 64)
 		if err != nil {
 			log.Warningln("Wrong pong time:", msg)
 			return nil
 		}
-		log.Infof("Ping time: %dns\n", time.Now().UnixNano()-sent)
+		rtt := time.Duration(time.Now().UnixNano() - sent)
+		log.Debugf("Ping time: %dns\n", rtt)
+		atomic.StoreInt32(&w.ponged, 1)
+		if w.OnPong != nil {
+			w.OnPong(rtt)
+		}
 		return nil
 	})
-	return &Ws{
-		Conn:       ws,
-		pingPeriod: pingPeriod,
-		copyBuf:    make([]byte, bufSize),
-	}
+	return w
 }
 
 // Must use BinaryMessage type
@@ -32,20 +39,24 @@ type Ws struct {
 	reader        io.Reader
 	pingPeriod    time.Duration
 	OnTextMessage func(r io.Reader)
+	OnPong        func(rtt time.Duration) // optional
+	OnMissedPong  func()                  // optional
+	MaxMissed     int                     // Ping closes after missed pongs in a row, 0 never
+	ponged        int32                   // pong of the last ping received
 }
 
-func (ws Ws) SetDeadline(t time.Time) error {
+func (ws *Ws) SetDeadline(t time.Time) error {
 	if err := ws.SetReadDeadline(t); err != nil {
 		return err
 	}
 	return ws.SetWriteDeadline(t)
 }
 
-func (ws Ws) WriteText(b []byte) error {
+func (ws *Ws) WriteText(b []byte) error {
 	return ws.Conn.WriteMessage(websocket.TextMessage, b)
 }
 
-func (ws Ws) Write(b []byte) (written int, err error) {
+func (ws *Ws) Write(b []byte) (written int, err error) {
 	err = ws.Conn.WriteMessage(websocket.BinaryMessage, b)
 	//	log.Infoln("ws sent", len(b))
 	return len(b), err
@@ -86,7 +97,7 @@ func (ws *Ws) Read(p []byte) (n int, err error) {
 }
 
 // Only used by io.Copy
-func (ws Ws) ReadFrom(r io.Reader) (int64, error) {
+func (ws *Ws) ReadFrom(r io.Reader) (int64, error) {
 	wc, err := ws.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		return -1, err
@@ -120,8 +131,13 @@ func (ws *Ws) WriteTo(w io.Writer) (written int64, err error) {
 	return written, err
 }
 
-// NOT compatable with funcs above
+// Ping sends timestamped pings every pingPeriod, the conn is closed when
+// MaxMissed pongs are missed in a row. Pings are control frames, so it is
+// safe with the funcs above.
 func (ws *Ws) Ping() {
+	if ws.pingPeriod <= 0 {
+		return
+	}
 	ticker := time.NewTicker(ws.pingPeriod)
 	defer func() {
 		log.Infoln("ping ticker stop")
@@ -129,14 +145,27 @@ func (ws *Ws) Ping() {
 		ws.Close()
 	}()
 
-	for {
-		select {
-		case <-ticker.C:
-			unixnano := strconv.FormatInt(time.Now().UnixNano(), 36)
-			if err := ws.WriteMessage(websocket.PingMessage, []byte(unixnano)); err != nil {
-				log.Errorln(err)
+	sent, missed := false, 0
+	for range ticker.C {
+		if sent && atomic.LoadInt32(&ws.ponged) == 0 {
+			missed++
+			if ws.OnMissedPong != nil {
+				ws.OnMissedPong()
+			}
+			if ws.MaxMissed > 0 && missed >= ws.MaxMissed {
+				log.Warningln("missed pongs:", missed, ws.RemoteAddr())
 				return
 			}
+		} else {
+			missed = 0
+		}
+
+		atomic.StoreInt32(&ws.ponged, 0)
+		unixnano := strconv.FormatInt(time.Now().UnixNano(), 36)
+		if err := ws.WriteControl(websocket.PingMessage, []byte(unixnano), time.Now().Add(ws.pingPeriod)); err != nil {
+			log.Errorln(err)
+			return
 		}
+		sent = true
 	}
 }
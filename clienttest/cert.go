@@ -0,0 +1,110 @@
+package clienttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Certs are self-signed certs of a test server, made on the fly.
+type Certs struct {
+	Pool   *x509.CertPool // trusts the CA
+	Server tls.Certificate
+
+	caPem, clientPem, clientKey []byte
+}
+
+// NewCerts makes a CA, a server cert for 127.0.0.1, localhost and
+// server.h2.proxy, and a client cert.
+func NewCerts() (*Certs, error) {
+	ca, caKey, caPem, _, err := newCert("wsh test CA", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, _, serverPem, serverKey, err := newCert("server.h2.proxy", ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	_, _, clientPem, clientKey, err := newCert("wsh test client", ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	server, err := tls.X509KeyPair(serverPem, serverKey)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &Certs{Pool: pool, Server: server, caPem: caPem, clientPem: clientPem, clientKey: clientKey}, nil
+}
+
+// WriteClientFiles writes client.crt, client.key and chain.pem to dir, the
+// files a client of tcp mode loads from its working dir.
+func (c *Certs) WriteClientFiles(dir string) error {
+	files := map[string][]byte{
+		"client.crt": c.clientPem,
+		"client.key": c.clientKey,
+		"chain.pem":  c.caPem,
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCert makes a CA if parent is nil, or a leaf signed by parent.
+func newCert(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tpl, key
+	} else {
+		tpl.DNSNames = []string{cn, "localhost"}
+		tpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		nil
+}
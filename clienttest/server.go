@@ -0,0 +1,229 @@
+// Package clienttest runs a local wsh server with fault injection, for tests
+// of the client. Tests import it from package client_test, since it imports
+// the client itself.
+package clienttest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/empirefox/wsh2c/client"
+	"github.com/empirefox/wsh2c/server"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+// Faults are injected into new conns and streams of a Server.
+type Faults struct {
+	Drop      bool          // close new conns before the inner tls handshake
+	Delay     time.Duration // before the inner tls handshake and each stream
+	Status    int           // answer streams with this status if not 0
+	Hosts     []string      // path.Match patterns of stream hosts for Status, all if empty
+	WrongALPN bool          // negotiate no protocol in the inner tls
+
+	// Info answers HOST_INFO instead of the server, like an incompatible
+	// version or missing features.
+	Info *client.ServerInfo
+}
+
+// Server is a wsh server on 127.0.0.1. Fields of Server may be changed before
+// the first client connects.
+type Server struct {
+	URL    *url.URL // ws://127.0.0.1:port or tcp://127.0.0.1:port
+	Certs  *Certs
+	Server *server.Server
+
+	l        net.Listener
+	mu       sync.Mutex
+	faults   Faults
+	live     map[net.Conn]bool
+	accepted int64
+	streams  int64
+}
+
+// NewServer starts a server of the ws mode, it panics on errors like
+// httptest.NewServer.
+func NewServer() *Server {
+	return newServer(server.MODE_WS)
+}
+
+// NewTCPServer starts a server of the tcp mode with client certs. The client
+// loads its cert files from the working dir, see Certs.WriteClientFiles.
+func NewTCPServer() *Server {
+	return newServer(server.MODE_TCP)
+}
+
+func newServer(mode string) *Server {
+	certs, err := NewCerts()
+	if err != nil {
+		panic("clienttest: " + err.Error())
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("clienttest: " + err.Error())
+	}
+	s := &Server{
+		URL:   &url.URL{Scheme: mode, Host: l.Addr().String()},
+		Certs: certs,
+		l:     l,
+		live:  make(map[net.Conn]bool),
+	}
+	s.Server = &server.Server{
+		Mode:        mode,
+		PingSecond:  1,
+		DialTimeout: 5 * time.Second,
+		Allow:       []string{"127.0.0.0/8", "::1/128"}, // test destinations
+		Wrap:        s.wrap,
+	}
+
+	if mode == server.MODE_TCP {
+		go s.serveTCP()
+	} else {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/p", s.serveWs)
+		go http.Serve(l, mux)
+	}
+	return s
+}
+
+// SetFaults replaces the faults injected from now on.
+func (s *Server) SetFaults(f Faults) {
+	s.mu.Lock()
+	s.faults = f
+	s.mu.Unlock()
+}
+
+func (s *Server) getFaults() Faults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faults
+}
+
+// Accepted is the number of conns accepted, including dropped ones.
+func (s *Server) Accepted() int {
+	return int(atomic.LoadInt64(&s.accepted))
+}
+
+// Streams is the number of h2 streams served.
+func (s *Server) Streams() int {
+	return int(atomic.LoadInt64(&s.streams))
+}
+
+// CloseConns closes the live conns, the listener keeps accepting.
+func (s *Server) CloseConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.live {
+		c.Close()
+	}
+}
+
+// Close stops the listener and closes the live conns.
+func (s *Server) Close() {
+	s.l.Close()
+	s.CloseConns()
+}
+
+// Client returns a client of the server listening on port, ready to Run.
+func (s *Server) Client(port string) *client.Client {
+	c := &client.Client{
+		Port:      port,
+		ServerUrl: s.URL,
+		RootCAs:   s.Certs.Pool,
+		BufSize:   64 << 10,
+		Dialer:    websocket.Dialer{HandshakeTimeout: 5 * time.Second},
+	}
+	c.PreRun()
+	return c
+}
+
+func (s *Server) serveTCP() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(c)
+	}
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+func (s *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.serveConn(client.NewWs(ws, 64<<10, 0))
+}
+
+// serveConn injects faults, then runs the inner tls and h2.
+func (s *Server) serveConn(c net.Conn) {
+	atomic.AddInt64(&s.accepted, 1)
+	defer c.Close()
+	f := s.getFaults()
+	if f.Drop {
+		return
+	}
+	time.Sleep(f.Delay)
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{s.Certs.Server}}
+	if !f.WrongALPN {
+		cfg.NextProtos = []string{http2.NextProtoTLS}
+	}
+	if s.Server.Mode == server.MODE_TCP {
+		cfg.ClientCAs = s.Certs.Pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	tc := tls.Server(c, cfg)
+	if err := tc.Handshake(); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.live[tc] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.live, tc)
+		s.mu.Unlock()
+	}()
+	s.Server.ServeH2(tc)
+}
+
+// wrap injects faults into streams.
+func (s *Server) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.streams, 1)
+		f := s.getFaults()
+		time.Sleep(f.Delay)
+		if f.Status != 0 && matchHost(f.Hosts, r.Host) {
+			http.Error(w, "clienttest fault", f.Status)
+			return
+		}
+		if f.Info != nil && r.Host == client.HOST_INFO {
+			json.NewEncoder(w).Encode(f.Info)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func matchHost(patterns []string, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/empirefox/wsh2c/server"
+)
+
+var (
+	listen = flag.String("listen", ":8000", "listen address")
+	mode   = flag.String("mode", server.MODE_WS, "ws, wss or tcp, tcp requires client certs signed by -ca")
+	cert   = flag.String("cert", "server.crt", "server certificate, its name must be server.h2.proxy in tcp mode")
+	key    = flag.String("key", "server.key", "key file of -cert")
+	ca     = flag.String("ca", "chain.pem", "CA of client certificates in tcp mode")
+	token  = flag.String("token", os.Getenv("WSH_TOKEN"), "bearer token required from clients in ws modes, defaults to $WSH_TOKEN")
+	anon   = flag.Bool("anonymous", false, "serve ws modes without a token, anonymous clients can not push the pac")
+	allow  = flag.String("allow", "", "comma separated CIDRs of destinations allowed even if denied")
+	deny   = flag.String("deny", strings.Join(server.DefaultDeny, ","), "comma separated CIDRs of denied destinations, empty denies none")
+	pac    = flag.String("pac", "", "pac template file served to clients and written by pac push")
+	ping   = flag.Int("ping", 30, "seconds between HOST_OK pings of clients")
+	dial   = flag.Duration("dialtimeout", 10*time.Second, "timeout of dialing destinations")
+	bind   = flag.String("bind", "", "address advertised at / for clients discovering the server, like example.com:443")
+	debug  = flag.Bool("debug", false, "enable debug logs")
+)
+
+func main() {
+	flag.Parse()
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+		server.SetLogLevel(log.DebugLevel)
+	}
+
+	crt, err := tls.LoadX509KeyPair(*cert, *key)
+	if err != nil {
+		log.Fatalf("load server certificate: %s", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{crt}}
+	if *mode == server.MODE_TCP {
+		pem, err := ioutil.ReadFile(*ca)
+		if err != nil {
+			log.Fatalf("load CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	s := &server.Server{
+		Addr:           *listen,
+		Mode:           *mode,
+		TLSConfig:      cfg,
+		Token:          *token,
+		AllowAnonymous: *anon,
+		Allow:          splitList(*allow),
+		Deny:           splitList(*deny),
+		PingSecond:     time.Duration(*ping),
+		PacFile:        *pac,
+		DialTimeout:    *dial,
+		Bind:           *bind,
+	}
+	log.Fatalln(s.ListenAndServe())
+}
+
+// splitList splits a comma separated flag, empty is an empty list.
+func splitList(v string) []string {
+	list := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -21,16 +29,114 @@ const (
 
 var (
 	p   = flag.String("p", "7777,tcp://127.0.0.1:9999", "proxy command")
-	up  = flag.Bool("up", false, "update pac to server")
+	tok = flag.String("token", os.Getenv("WSH_TOKEN"), "bearer token of ws servers, defaults to $WSH_TOKEN")
+	up  = flag.Bool("up", false, "trigger a pac update on the server, see also: wsh pac")
 	h2v = flag.Bool("h2v", false, "enable http2 verbose logs")
 
+	lcert = flag.String("lcert", "", "certificate file to accept tls(h2) from local clients")
+	lkey  = flag.String("lkey", "", "key file of -lcert")
+
+	maxConns    = flag.Int("maxconns", 0, "max concurrent connections and local h2 streams per listener, 0 for no limit")
+	queue       = flag.Duration("queue", 5*time.Second, "wait for a free connection slot before 503")
+	readTimeout = flag.Duration("rht", 30*time.Second, "read timeout for the initial request")
+	idle        = flag.Duration("idle", 0, "close CONNECT streams idle for this long, 0 disables")
+
+	shape   = flag.String("shape", "", "bandwidth limits json file")
+	traffic = flag.String("traffic", "", "file to save traffic counters")
+	quota   = flag.String("quota", "", "traffic quotas json file")
+	rules   = flag.String("rules", "", "routing rules file, route everything to PROXY if empty")
+	evalPac = flag.Bool("evalpac", false, "route by the pac when no rule matched")
+	geoip   = flag.String("geoip", "", "MaxMind country database (.mmdb) for GEOIP rules")
+	genPac  = flag.String("genpac", "", "generate the pac from these comma separated rule sets instead of fetching it")
+
+	cacheDir   = flag.String("cachedir", defaultCacheDir(), "cache dir of fetched pac files, empty to disable")
+	pacRefresh = flag.Duration("pacrefresh", time.Hour, "refresh the pac in background, 0 to disable")
+	pacMaxAge  = flag.Duration("pacmaxage", 0, "Cache-Control max-age of the served pac, 0 for no-cache")
+
+	dnsAddr        = flag.String("dns", "", "listen address of the local dns server, like 127.0.0.1:5353, empty to disable")
+	doh            = flag.String("doh", "https://1.1.1.1/dns-query", "DoH endpoint the dns server queries through the tunnel")
+	dnsLocal       = flag.String("dnslocal", "", "comma separated domain suffixes resolved by -dnslocalserver")
+	dnsLocalServer = flag.String("dnslocalserver", "", "local dns server of -dnslocal, like 192.168.1.1:53")
+	fakeIP         = flag.String("fakeip", "", "answer A queries with fake ips of this range, like 198.18.0.0/15")
+
+	accessLog        = flag.String("accesslog", "", "access log sink: stderr, syslog, syslog:<socket> or a file, empty to disable")
+	accessFormat     = flag.String("accessformat", "json", "access log format: json or combined")
+	accessMaxSize    = flag.Int("accessmaxsize", 100, "megabytes of the access log file before rotating")
+	accessMaxBackups = flag.Int("accessbackups", 7, "rotated access log files to keep, 0 keeps all")
+	accessMaxAge     = flag.Int("accessmaxage", 0, "days to keep rotated access log files, 0 keeps all")
+
+	harDir     = flag.String("har", "", "directory to capture HAR files of plain http and CONNECT metadata, empty to disable")
+	harHosts   = flag.String("harhosts", "", "comma separated host patterns to capture, like *.example.com, empty captures all")
+	harBody    = flag.Int("harbody", 64<<10, "bytes kept of each captured body")
+	harEntries = flag.Int("harentries", 1000, "entries of a HAR file before rotating")
+	harFiles   = flag.Int("harfiles", 10, "HAR files to keep, 0 keeps all")
+	harCreds   = flag.Bool("harcreds", false, "capture credential headers and cookies unredacted")
+
+	otlp      = flag.String("otlp", "", "OTLP/http endpoint to export traces, like http://127.0.0.1:4318, empty to disable")
+	traceProp = flag.Bool("traceprop", false, "send the trace context to the server in the traceparent header")
+
+	infoTTL     = flag.Duration("infottl", 10*time.Minute, "refetch the server info on each conn after this, 0 only on new conns")
+	pingPeriod  = flag.Duration("ping", 5*time.Second, "websocket ping period to measure rtt, 0 to disable")
+	missedPongs = flag.Int("missedpongs", 3, "close the websocket after missed pongs in a row, 0 never")
+
+	recordDir  = flag.String("record", "", "directory to record the h2 frames of server conns, empty to disable")
+	replayAddr = flag.String("replay", "", "dial a replay server at this address instead of the server")
+
+	admin = flag.String("admin", "", "admin api address on loopback like 127.0.0.1:7770, or unix:/path/to/sock")
+
+	ruleSets   ruleSetFlags
+	pacSources = make(pacSourceFlags)
+
 	// compile time to set defaultProxy:
 	// go build -ldflags "-X main.defaultProxy=7777,$WSH_HTTP_PROXY"
 	defaultProxy  string
 	versionNumber string
 )
 
+// ruleSetFlags collects -ruleset name=file|url
+type ruleSetFlags []*client.RuleSet
+
+func (f *ruleSetFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *ruleSetFlags) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("rule set MUST be name=file|url: %s", v)
+	}
+	*f = append(*f, &client.RuleSet{Name: parts[0], Source: parts[1]})
+	return nil
+}
+
+// pacSourceFlags collects -pacsrc port=file|url
+type pacSourceFlags map[string]string
+
+func (f pacSourceFlags) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f pacSourceFlags) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("pac source MUST be port=file|url: %s", v)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "wsh")
+}
+
 func init() {
+	flag.Var(&ruleSets, "ruleset", "gfwlist or domain list as name=file|url, urls are fetched through the tunnel, repeatable")
+	flag.Var(pacSources, "pacsrc", "pac of a listener as port=file|url instead of its server, repeatable")
+
 	// Log as JSON instead of the default ASCII formatter.
 	log.SetFormatter(&log.TextFormatter{})
 
@@ -51,6 +157,13 @@ func main() {
 	flag.Parse()
 	http2.VerboseLogs = *h2v
 
+	if flag.Arg(0) == "top" {
+		os.Exit(runTop(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "replay" {
+		os.Exit(runReplay(flag.Args()[1:]))
+	}
+
 	if defaultProxy == "" {
 		defaultProxy = *p
 	}
@@ -59,27 +172,364 @@ func main() {
 		log.Fatalf("invalid proxy command: %s", err)
 	}
 
+	if flag.Arg(0) == "pac" {
+		os.Exit(runPac(pacClient(ps, flag.Arg(1) == "test"), flag.Args()[1:]))
+	}
+
+	// deprecated, use the pac subcommands
+	if *up {
+		if _, err = pacClient(ps, false).FetchPac(true); err != nil {
+			log.Fatalf("update pac: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	var localTLS *tls.Config
+	if *lcert != "" {
+		cert, err := tls.LoadX509KeyPair(*lcert, *lkey)
+		if err != nil {
+			log.Fatalf("load local certificate: %s", err)
+		}
+		localTLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+
+	var shaper *client.Shaper
+	if *shape != "" {
+		cfg, err := client.LoadShaperConfig(*shape)
+		if err != nil {
+			log.Fatalf("load bandwidth limits: %s", err)
+		}
+		shaper = client.NewShaper(cfg)
+	}
+
+	var accountant *client.Accountant
+	if *traffic != "" || *quota != "" {
+		var quotas *client.QuotaConfig
+		if *quota != "" {
+			if quotas, err = client.LoadQuotaConfig(*quota); err != nil {
+				log.Fatalf("load quotas: %s", err)
+			}
+		}
+		if accountant, err = client.NewAccountant(*traffic, quotas); err != nil {
+			log.Fatalf("load traffic counters: %s", err)
+		}
+		go accountant.SaveEvery(time.Minute)
+	}
+
+	router := newRouter()
+
+	shutdown := func(context.Context) error { return nil }
+	if *otlp != "" {
+		if shutdown, err = client.StartTracing(*otlp); err != nil {
+			log.Fatalf("start tracing: %s", err)
+		}
+	}
+	defer shutdown(context.Background())
+
+	var access *client.AccessLog
+	if *accessLog != "" {
+		access, err = client.OpenAccessLog(client.AccessLogConfig{
+			Sink:       *accessLog,
+			Format:     *accessFormat,
+			MaxSize:    *accessMaxSize,
+			MaxBackups: *accessMaxBackups,
+			MaxAge:     *accessMaxAge,
+		})
+		if err != nil {
+			log.Fatalf("open access log: %s", err)
+		}
+	}
+
+	var capture *client.Capture
+	if *harDir != "" {
+		capture = &client.Capture{
+			Dir:             *harDir,
+			MaxBody:         *harBody,
+			MaxEntries:      *harEntries,
+			MaxFiles:        *harFiles,
+			KeepCredentials: *harCreds,
+		}
+		if *harHosts != "" {
+			capture.Hosts = strings.Split(*harHosts, ",")
+		}
+	}
+	go closeOnExit(accountant, capture, shutdown)
+
+	var fakeIPs *client.FakeIPPool
+	if *fakeIP != "" {
+		if fakeIPs, err = client.NewFakeIPPool(*fakeIP); err != nil {
+			log.Fatalf("fakeip: %s", err)
+		}
+	}
+
 	var clients []*client.Client
 	for _, p := range ps {
 		for _, port := range p.ports {
-			clients = append(clients, newClient(port, p))
+			c := newClient(port, p)
+			c.TLSConfig = localTLS
+			c.Shaper = shaper
+			c.Accountant = accountant
+			c.Router = router
+			c.EvalPac = *evalPac
+			c.PacSource = pacSources[port]
+			c.PacCacheDir = *cacheDir
+			c.PacMaxAge = *pacMaxAge
+			c.FakeIP = fakeIPs
+			c.AccessLog = access
+			c.Capture = capture
+			c.PropagateTrace = *traceProp
+			c.RecordDir = *recordDir
+			c.ReplayAddr = *replayAddr
+			clients = append(clients, c)
 		}
 	}
 
-	pac, err := clients[0].FetchPac(*up)
-	if err != nil {
-		log.Fatalf("fetch pac: %s", err)
+	sets := loadRuleSets(clients[0])
+	checkRouter(router, sets)
+	var gen []*client.RuleSet
+	if *genPac != "" {
+		for _, name := range strings.Split(*genPac, ",") {
+			rs, ok := sets[name]
+			if !ok {
+				log.Fatalf("genpac: no rule set %s", name)
+			}
+			gen = append(gen, rs)
+		}
 	}
-	if *up {
-		os.Exit(0)
+	var genTpl *template.Template
+	var regen func() error
+	if gen != nil {
+		if genTpl, err = client.GeneratePac(gen...); err != nil {
+			log.Fatalf("genpac: %s", err)
+		}
+		regen = func() error { return setGenPac(clients, gen) }
 	}
+	reload := func() error { return reloadConfig(router, sets, regen, shaper, accountant) }
+	go reloadOnHup(reload)
 
 	quit := make(chan struct{})
+	if *admin != "" {
+		a := &client.Admin{
+			Addr:       *admin,
+			Clients:    clients,
+			Shaper:     shaper,
+			Accountant: accountant,
+			Reload:     reload,
+		}
+		go func() {
+			log.Errorln(a.ListenAndServe())
+			quit <- struct{}{}
+		}()
+	}
+	if *dnsAddr != "" {
+		dnsServer := &client.DNSServer{
+			Addr:     *dnsAddr,
+			DoH:      *doh,
+			Client:   clients[0],
+			LocalDNS: *dnsLocalServer,
+			FakeIP:   fakeIPs,
+		}
+		if *dnsLocal != "" {
+			dnsServer.Local = strings.Split(*dnsLocal, ",")
+		}
+		go func() {
+			log.Errorln(dnsServer.ListenAndServe())
+			quit <- struct{}{}
+		}()
+	}
 	for _, c := range clients {
-		c.PacTpl = pac
+		pac, version := genTpl, ""
+		if pac == nil {
+			if c.PacSource == "" {
+				c.OnServerInfo = reloadPacOnChange(c)
+			}
+			if pac, version, err = c.LoadPac(); err != nil {
+				log.Fatalf("fetch pac of port %s: %s", c.Port, err)
+			}
+			if *pacRefresh > 0 {
+				go c.RefreshPac(*pacRefresh, version)
+			}
+		}
+		if err = c.SetPac(pac); err != nil {
+			log.Fatalf("eval pac: %s", err)
+		}
 		go serveProxy(c, quit)
 	}
 	<-quit
+	capture.Close()
+}
+
+// reloadPacOnChange reloads the pac of c when the server has a new one.
+func reloadPacOnChange(c *client.Client) func(old, info *client.ServerInfo) {
+	return func(old, info *client.ServerInfo) {
+		if old == nil || old.PacVersion == info.PacVersion {
+			return
+		}
+		go func() {
+			if err := c.ReloadPac(); err != nil {
+				log.WithError(err).WithField("port", c.Port).Errorln("reload pac")
+			}
+		}()
+	}
+}
+
+// closeOnExit saves the traffic counters, writes the queued HAR entries and
+// flushes the spans on SIGINT or SIGTERM, then exits.
+func closeOnExit(a *client.Accountant, capture *client.Capture, shutdown func(context.Context) error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Infoln("exiting on", <-sig)
+	code := 0
+	if a != nil {
+		if err := a.Save(); err != nil {
+			log.WithError(err).Errorln("save traffic counters")
+			code = 1
+		}
+	}
+	if err := capture.Close(); err != nil {
+		log.WithError(err).Errorln("close har capture")
+		code = 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdown(ctx); err != nil {
+		log.WithError(err).Errorln("shutdown tracing")
+		code = 1
+	}
+	cancel()
+	os.Exit(code)
+}
+
+// reloadOnHup calls reload on SIGHUP.
+func reloadOnHup(reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reload() // errors are logged
+	}
+}
+
+// setGenPac generates the pac of -genpac again and sets it on clients.
+func setGenPac(clients []*client.Client, gen []*client.RuleSet) error {
+	tpl, err := client.GeneratePac(gen...)
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		if err = c.SetPac(tpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadConfig reloads rules, the GeoIP database, rule sets, bandwidth
+// limits and quotas, regen generates the pac of the rule sets again if set.
+// All are reloaded even if some failed, the first error is returned.
+func reloadConfig(router *client.Router, sets map[string]*client.RuleSet, regen func() error, shaper *client.Shaper, accountant *client.Accountant) error {
+	var first error
+	fail := func(err error) {
+		log.Errorln(err)
+		if first == nil {
+			first = err
+		}
+	}
+	if router != nil {
+		if err := router.Reload(); err != nil {
+			fail(fmt.Errorf("reload rules: %s", err))
+		}
+		if router.GeoIP != nil {
+			if err := router.GeoIP.Reload(); err != nil {
+				fail(fmt.Errorf("reload geoip: %s", err))
+			}
+		}
+	}
+	for _, rs := range sets {
+		if err := rs.Load(); err != nil {
+			fail(err)
+		}
+	}
+	if regen != nil {
+		if err := regen(); err != nil {
+			fail(fmt.Errorf("genpac: %s", err))
+		}
+	}
+	if shaper != nil {
+		cfg, err := client.LoadShaperConfig(*shape)
+		if err != nil {
+			fail(fmt.Errorf("reload bandwidth limits: %s", err))
+		} else {
+			shaper.Reload(cfg)
+		}
+	}
+	if accountant != nil && *quota != "" {
+		quotas, err := client.LoadQuotaConfig(*quota)
+		if err != nil {
+			fail(fmt.Errorf("reload quotas: %s", err))
+		} else {
+			accountant.SetQuotas(quotas)
+		}
+	}
+	return first
+}
+
+// pacClient is the client of the first listener for the pac subcommands,
+// without the listeners and other services. withRules loads the rules, rule
+// sets and GeoIP database like run.
+func pacClient(ps []*proxy, withRules bool) *client.Client {
+	port := ps[0].ports[0]
+	c := newClient(port, ps[0])
+	if withRules {
+		c.Router = newRouter()
+		checkRouter(c.Router, loadRuleSets(c))
+	}
+	return c
+}
+
+// newRouter loads -rules and -geoip, nil without -rules.
+func newRouter() *client.Router {
+	if *geoip != "" && *rules == "" {
+		log.Fatalln("-geoip is only used by GEOIP rules of -rules")
+	}
+	if *rules == "" {
+		return nil
+	}
+	router, err := client.NewRouter(*rules)
+	if err != nil {
+		log.Fatalf("load rules: %s", err)
+	}
+	if *geoip != "" {
+		if router.GeoIP, err = client.OpenGeoIP(*geoip); err != nil {
+			log.Fatalf("load geoip: %s", err)
+		}
+	}
+	return router
+}
+
+// loadRuleSets loads -ruleset, urls are fetched through the tunnel of c.
+func loadRuleSets(c *client.Client) map[string]*client.RuleSet {
+	sets := make(map[string]*client.RuleSet)
+	for _, rs := range ruleSets {
+		rs.Client = c.HTTPClient()
+		if err := rs.Load(); err != nil {
+			log.Fatalln(err)
+		}
+		sets[rs.Name] = rs
+	}
+	return sets
+}
+
+// checkRouter sets the rule sets of router and checks its rules.
+func checkRouter(router *client.Router, sets map[string]*client.RuleSet) {
+	if router == nil {
+		return
+	}
+	router.Sets = sets
+	if err := router.Check(); err != nil {
+		log.Fatalf("%s: %s", *rules, err)
+	}
 }
 
 func serveProxy(c *client.Client, quit chan struct{}) {
@@ -91,12 +541,20 @@ func newClient(port string, p *proxy) *client.Client {
 	c := &client.Client{
 		Port:       port,
 		ServerUrl:  p.serverUrl,
-		PingPeriod: time.Second * 40,
+		Token:      *tok,
+		PingPeriod: *pingPeriod,
 		Dialer: websocket.Dialer{
 			ReadBufferSize:  bufSize,
 			WriteBufferSize: bufSize,
 		},
 		BufSize: bufSize,
+
+		MaxConns:          *maxConns,
+		QueueTimeout:      *queue,
+		ReadHeaderTimeout: *readTimeout,
+		IdleTimeout:       *idle,
+		MaxMissedPongs:    *missedPongs,
+		ServerInfoTTL:     *infoTTL,
 	}
 
 	if p.tcpIp != "" {
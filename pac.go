@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/empirefox/wsh2c/client"
+)
+
+const pacUsage = `usage: wsh [flags] pac <command>
+
+commands:
+  get          print the current pac of the server
+  push <file>  validate and upload a pac template to the server
+  diff <file>  diff a pac template against the server
+  test <url>   evaluate the pac of the server locally and print the decision
+`
+
+// runPac runs the pac subcommands against the first listener's server.
+func runPac(c *client.Client, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, pacUsage)
+		return 2
+	}
+
+	var err error
+	switch {
+	case args[0] == "get" && len(args) == 1:
+		var body []byte
+		if body, err = c.GetPac(); err == nil {
+			os.Stdout.Write(body)
+		}
+	case args[0] == "push" && len(args) == 2:
+		err = pacPush(c, args[1])
+	case args[0] == "diff" && len(args) == 2:
+		err = pacDiff(c, args[1])
+	case args[0] == "test" && len(args) == 2:
+		err = pacTest(c, args[1])
+	default:
+		fmt.Fprint(os.Stderr, pacUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pac", args[0]+":", err)
+		return 1
+	}
+	return 0
+}
+
+// validatePac parses the template and compiles the resulting script.
+func validatePac(body []byte) (*template.Template, error) {
+	tpl, err := template.New("pac").Parse(string(body))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = client.NewPacEvaluator(tpl, "127.0.0.1:7777"); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+func pacPush(c *client.Client, file string) error {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if _, err = validatePac(body); err != nil {
+		return err
+	}
+	if err = c.PushPac(body); err != nil {
+		return err
+	}
+	fmt.Println("pac pushed:", file)
+	return nil
+}
+
+func pacDiff(c *client.Client, file string) error {
+	local, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	remote, err := c.GetPac()
+	if err != nil {
+		return err
+	}
+	lines := diffLines(strings.Split(string(remote), "\n"), strings.Split(string(local), "\n"))
+	if lines == nil {
+		return nil
+	}
+	fmt.Printf("--- server\n+++ %s\n", file)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func pacTest(c *client.Client, rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("url MUST be absolute: %s", rawurl)
+	}
+	body, err := c.GetPac()
+	if err != nil {
+		return err
+	}
+	tpl, err := template.New("pac").Parse(string(body))
+	if err != nil {
+		return err
+	}
+	eval, err := client.NewPacEvaluator(tpl, "127.0.0.1:"+c.Port)
+	if err != nil {
+		return err
+	}
+	result, err := eval.FindProxyForURL(rawurl, u.Hostname())
+	if err != nil {
+		return err
+	}
+	fmt.Println("FindProxyForURL:", result)
+
+	c.EvalPac = true
+	if err = c.SetPac(tpl); err != nil {
+		return err
+	}
+	target := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		target = net.JoinHostPort(u.Hostname(), port)
+	}
+	action, rule := c.Route(target)
+	if rule != nil {
+		fmt.Println("decision:", action, "by", rule)
+	} else {
+		fmt.Println("decision:", action, "by default")
+	}
+	return nil
+}
+
+// diffLines returns a line diff of a and b, nil if equal. Only the changed
+// middle part is compared, large changes are shown as a whole.
+func diffLines(a, b []string) []string {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+
+	out := []string{fmt.Sprintf("@@ -%d,%d +%d,%d @@", prefix+1, len(a), prefix+1, len(b))}
+	if len(a)*len(b) > 4<<20 {
+		for _, line := range a {
+			out = append(out, "-"+line)
+		}
+		for _, line := range b {
+			out = append(out, "+"+line)
+		}
+		return out
+	}
+
+	// lcs[i][j] is the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/empirefox/wsh2c/client"
+)
+
+const replayUsage = `usage: wsh replay [-listen addr] [-pace] <file.frames>...
+
+serves the responses of frames recorded with -record, run wsh with
+-replay addr to use it instead of the server
+`
+
+// runReplay serves recorded frames until killed.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, replayUsage) }
+	listen := fs.String("listen", "127.0.0.1:7780", "listen address")
+	pace := fs.Bool("pace", false, "keep the recorded delays between data frames")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	s, err := client.LoadReplay(fs.Args()...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	s.Pace = *pace
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	fmt.Println("replay is on", l.Addr())
+	if err = s.Serve(l); err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	return 0
+}
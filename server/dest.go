@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// DefaultDeny is used when Server.Deny is nil: the server itself and the
+// private networks around it are not destinations.
+var DefaultDeny = []string{
+	"0.0.0.0/8", "127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"100.64.0.0/10", "169.254.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+}
+
+var errDenied = errors.New("destination denied")
+
+// destinations is the parsed Allow and Deny of a Server.
+type destinations struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("destination: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// initDests parses Allow and Deny once, before serving.
+func (s *Server) initDests() error {
+	s.destsOnce.Do(func() {
+		deny := s.Deny
+		if deny == nil {
+			deny = DefaultDeny
+		}
+		d := &destinations{}
+		if d.allow, s.destsErr = parseNets(s.Allow); s.destsErr != nil {
+			return
+		}
+		if d.deny, s.destsErr = parseNets(deny); s.destsErr != nil {
+			return
+		}
+		s.dests = d
+	})
+	return s.destsErr
+}
+
+// allowed checks the ip of a destination, Allow overrides Deny.
+func (d *destinations) allowed(ip net.IP) bool {
+	for _, n := range d.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range d.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// control checks the resolved address right before connecting, so names
+// resolving to denied networks are denied too.
+func (d *destinations) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !d.allowed(ip) {
+		return errDenied
+	}
+	return nil
+}
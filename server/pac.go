@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const maxPacSize = 4 << 20
+
+// loadPac reads PacFile, a missing file is an empty pac.
+func (s *Server) loadPac() error {
+	if s.PacFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.PacFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.muPac.Lock()
+	s.pac = b
+	s.muPac.Unlock()
+	return nil
+}
+
+// pacVersion is a hash of the pac, empty if no pac.
+func (s *Server) pacVersion() string {
+	s.muPac.RLock()
+	defer s.muPac.RUnlock()
+	return versionOf(s.pac)
+}
+
+func versionOf(pac []byte) string {
+	if len(pac) == 0 {
+		return ""
+	}
+	sum := sha1.Sum(pac)
+	return hex.EncodeToString(sum[:8])
+}
+
+// writePac writes the pac with its version as ETag, 304 if the client has
+// it already.
+func (s *Server) writePac(w http.ResponseWriter, r *http.Request) {
+	s.muPac.RLock()
+	pac := s.pac
+	s.muPac.RUnlock()
+	if len(pac) == 0 {
+		http.Error(w, "no pac", http.StatusNotFound)
+		return
+	}
+	etag := `"` + versionOf(pac) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(pac)
+}
+
+// etagMatch reports whether the If-None-Match header matches etag, weak
+// tags match too.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPac validates and stores a pac template like a pac push.
+func (s *Server) SetPac(b []byte) error {
+	return s.putPac(bytes.NewReader(b))
+}
+
+// putPac validates and stores a pac template, the template is executed with
+// the local proxy address like the client does.
+func (s *Server) putPac(r io.Reader) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxPacSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxPacSize {
+		return fmt.Errorf("pac is larger than %d bytes", maxPacSize)
+	}
+	tpl, err := template.New("pac").Parse(string(b))
+	if err != nil {
+		return err
+	}
+	if err = tpl.Execute(ioutil.Discard, "127.0.0.1:7777"); err != nil {
+		return err
+	}
+
+	if s.PacFile != "" {
+		tmp := s.PacFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+			return err
+		}
+		if err = os.Rename(tmp, s.PacFile); err != nil {
+			return err
+		}
+	}
+	s.muPac.Lock()
+	s.pac = b
+	s.muPac.Unlock()
+	return nil
+}
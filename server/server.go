@@ -0,0 +1,231 @@
+// Package server is the wsh server: it accepts websocket or tcp+mTLS conns
+// from wsh clients, runs h2 over the inner tls and proxies their streams.
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/empirefox/wsh2c/client"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+const (
+	MODE_WS  = "ws"  // websocket on /p, tls inside
+	MODE_WSS = "wss" // like ws, the websocket is also over tls
+	MODE_TCP = "tcp" // tls with client certs on raw tcp
+
+	// MIN_CLIENT_VERSION is the oldest client protocol served, clients
+	// before versioning speak version 1.
+	MIN_CLIENT_VERSION = 1
+
+	bufSize           = 64 << 10
+	defaultMaxStreams = 250 // of http2.Server
+)
+
+var (
+	log = logrus.New()
+)
+
+func SetLogLevel(level logrus.Level) {
+	log.Level = level
+}
+
+type Server struct {
+	Addr string
+	Mode string // MODE_WS, MODE_WSS or MODE_TCP
+
+	// TLSConfig is the inner tls of ws modes, the outer of MODE_WSS, and
+	// the only one of MODE_TCP where client certs must be verified. The
+	// tcp client expects the name server.h2.proxy.
+	TLSConfig *tls.Config
+
+	// Token is required as "Authorization: Bearer <Token>" on the websocket
+	// upgrade. Ws modes MUST authenticate clients by Token or by client
+	// certs in TLSConfig, unless AllowAnonymous. Anonymous clients can not
+	// push the pac.
+	Token          string
+	AllowAnonymous bool
+
+	// Allow and Deny are CIDRs of destinations, Allow overrides Deny. Deny
+	// is DefaultDeny if nil.
+	Allow []string
+	Deny  []string
+
+	PingSecond  time.Duration // ServerInfo.PingSecond, in seconds
+	PacFile     string        // storage of the pac template, optional
+	DialTimeout time.Duration // to destinations
+	Bind        string        // advertised at / for clients discovering the server
+
+	// Wrap optionally wraps the handler of h2 streams, like for tests.
+	Wrap func(http.Handler) http.Handler
+
+	h2        http2.Server
+	pac       []byte
+	muPac     sync.RWMutex
+	dests     *destinations
+	destsOnce sync.Once
+	destsErr  error
+}
+
+// anonymousKey marks the context of streams of anonymous clients.
+type anonymousKey struct{}
+
+// ListenAndServe listens on Addr and serves by Mode.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Infoln("wsh server is on", l.Addr(), s.Mode)
+	return s.Serve(l)
+}
+
+// Serve serves l by Mode.
+func (s *Server) Serve(l net.Listener) error {
+	if err := s.loadPac(); err != nil {
+		return err
+	}
+	if err := s.initDests(); err != nil {
+		return err
+	}
+	if s.Mode != MODE_TCP && s.Token == "" && !s.clientCerts() && !s.AllowAnonymous {
+		return errors.New("ws modes require a Token or client certs, or AllowAnonymous")
+	}
+	switch s.Mode {
+	case MODE_TCP:
+		if !s.clientCerts() {
+			return errors.New("tcp mode requires client certs")
+		}
+		return s.serveTCP(tls.NewListener(l, s.innerTLS()))
+	case MODE_WSS:
+		outer := s.TLSConfig.Clone()
+		outer.NextProtos = []string{"http/1.1"}
+		l = tls.NewListener(l, outer)
+	case MODE_WS, "":
+	default:
+		return fmt.Errorf("unknown mode %q", s.Mode)
+	}
+	return (&http.Server{Handler: s.Handler()}).Serve(l)
+}
+
+func (s *Server) serveTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			tc := c.(*tls.Conn)
+			if err := tc.Handshake(); err != nil {
+				log.WithError(err).Debugln("tls handshake", c.RemoteAddr())
+				c.Close()
+				return
+			}
+			s.ServeH2(tc)
+		}()
+	}
+}
+
+// Handler serves the websocket upgrade on /p and the server address on /.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/p", s.serveWs)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || s.Bind == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"schema": s.Mode, "bind": s.Bind})
+	})
+	return mux
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  bufSize,
+	WriteBufferSize: bufSize,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// clientCerts reports whether the inner tls verifies client certs.
+func (s *Server) clientCerts() bool {
+	return s.TLSConfig != nil && s.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert
+}
+
+// authorized checks the bearer token of the upgrade request.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(s.Token)) == 1
+}
+
+func (s *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		log.Debugln("unauthorized upgrade", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).Debugln("ws upgrade", r.RemoteAddr)
+		return
+	}
+	tc := tls.Server(client.NewWs(ws, bufSize, 0), s.innerTLS())
+	if err := tc.Handshake(); err != nil {
+		log.WithError(err).Debugln("tls handshake", r.RemoteAddr)
+		ws.Close()
+		return
+	}
+	s.serveH2(tc, s.Token == "" && !s.clientCerts())
+}
+
+// innerTLS is TLSConfig offering h2 only.
+func (s *Server) innerTLS() *tls.Config {
+	cfg := s.TLSConfig.Clone()
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	return cfg
+}
+
+// ServeH2 serves the streams of c after the inner tls handshake, the client
+// of c MUST be authenticated.
+func (s *Server) ServeH2(c net.Conn) {
+	s.serveH2(c, false)
+}
+
+func (s *Server) serveH2(c net.Conn, anonymous bool) {
+	if err := s.initDests(); err != nil {
+		log.WithError(err).Errorln("h2 conn")
+		c.Close()
+		return
+	}
+	log.Debugln("h2 conn started", c.RemoteAddr(), "anonymous", anonymous)
+	var h http.Handler = http.HandlerFunc(s.serveStream)
+	if s.Wrap != nil {
+		h = s.Wrap(h)
+	}
+	ctx := context.WithValue(context.Background(), anonymousKey{}, anonymous)
+	s.h2.ServeConn(c, &http2.ServeConnOpts{Context: ctx, Handler: h})
+	c.Close()
+	log.Debugln("h2 conn closed", c.RemoteAddr())
+}
+
+func isAnonymous(r *http.Request) bool {
+	anonymous, _ := r.Context().Value(anonymousKey{}).(bool)
+	return anonymous
+}
@@ -0,0 +1,252 @@
+package server_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/empirefox/wsh2c/client"
+	"github.com/empirefox/wsh2c/clienttest"
+	"github.com/empirefox/wsh2c/server"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+const testPac = `function FindProxyForURL(url, host) { return "PROXY {{.}}"; }`
+
+// serve runs s on a free port until the test ends, it returns the address.
+func serve(t *testing.T, s *server.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// echo serves conns that echo what they read, like a destination.
+func echo(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// h2Conn runs the inner tls and h2 over c like the client does.
+func h2Conn(t *testing.T, c net.Conn, cfg *tls.Config) (*http2.ClientConn, error) {
+	cfg.ServerName = "server.h2.proxy"
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	tc := tls.Client(c, cfg)
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	cc, err := (&http2.Transport{}).NewClientConn(tc)
+	if err != nil {
+		tc.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc, nil
+}
+
+// dialWs upgrades to the websocket on /p with token, it returns the status
+// of a refused upgrade.
+func dialWs(t *testing.T, addr, token string, certs *clienttest.Certs) (*http2.ClientConn, int) {
+	var header http.Header
+	if token != "" {
+		header = http.Header{"Authorization": {"Bearer " + token}}
+	}
+	ws, res, err := websocket.DefaultDialer.Dial("ws://"+addr+"/p", header)
+	if err != nil {
+		if res == nil {
+			t.Fatal(err)
+		}
+		return nil, res.StatusCode
+	}
+	cc, err := h2Conn(t, client.NewWs(ws, 64<<10, 0), &tls.Config{RootCAs: certs.Pool})
+	if err != nil {
+		t.Fatalf("inner tls: %v", err)
+	}
+	return cc, res.StatusCode
+}
+
+// do sends a stream to host, it returns the status.
+func do(t *testing.T, cc *http2.ClientConn, method, host, body string) (int, error) {
+	req := &http.Request{
+		Method: method,
+		URL:    &url.URL{Scheme: "https", Host: host, Path: "/"},
+		Host:   host,
+		Header: make(http.Header),
+	}
+	if method == "CONNECT" {
+		req.URL = &url.URL{Host: host}
+	}
+	if body != "" {
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := cc.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func TestWsMode(t *testing.T) {
+	certs, err := clienttest.NewCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, &server.Server{
+		Mode:      server.MODE_WS,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certs.Server}},
+		Token:     "secret",
+		Allow:     []string{"127.0.0.0/8"},
+	})
+
+	for _, token := range []string{"", "wrong"} {
+		if _, status := dialWs(t, addr, token, certs); status != http.StatusUnauthorized {
+			t.Errorf("upgrade with token %q: %d, want 401", token, status)
+		}
+	}
+
+	cc, _ := dialWs(t, addr, "secret", certs)
+	tests := []struct {
+		method, host, body string
+		want               int
+	}{
+		{"GET", client.HOST_INFO, "", http.StatusOK},
+		{"CONNECT", echo(t), "", http.StatusOK}, // Allow overrides DefaultDeny
+		{"PUT", client.HOST_PAC, testPac, http.StatusNoContent},
+		{"GET", client.HOST_PAC, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		status, err := do(t, cc, tt.method, tt.host, tt.body)
+		if err != nil || status != tt.want {
+			t.Errorf("%s %s: %d %v, want %d", tt.method, tt.host, status, err, tt.want)
+		}
+	}
+}
+
+func TestWsAnonymous(t *testing.T) {
+	certs, err := clienttest.NewCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server.Server{
+		Mode:      server.MODE_WS,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certs.Server}},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err = s.Serve(l); err == nil || !strings.Contains(err.Error(), "Token") {
+		t.Fatalf("Serve without a Token or client certs: %v", err)
+	}
+
+	s.AllowAnonymous = true
+	cc, _ := dialWs(t, serve(t, s), "", certs)
+	tests := []struct {
+		method, host, body string
+		want               int
+	}{
+		{"PUT", client.HOST_PAC, testPac, http.StatusForbidden},
+		{"GET", client.HOST_PAC, "", http.StatusNotFound},
+		{"CONNECT", echo(t), "", http.StatusForbidden}, // DefaultDeny
+	}
+	for _, tt := range tests {
+		status, err := do(t, cc, tt.method, tt.host, tt.body)
+		if err != nil || status != tt.want {
+			t.Errorf("%s %s: %d %v, want %d", tt.method, tt.host, status, err, tt.want)
+		}
+	}
+}
+
+func TestTCPMode(t *testing.T) {
+	certs, err := clienttest.NewCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = certs.WriteClientFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, &server.Server{
+		Mode: server.MODE_TCP,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certs.Server},
+			ClientCAs:    certs.Pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	})
+
+	dial := func(clientCerts ...tls.Certificate) (*http2.ClientConn, error) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h2Conn(t, c, &tls.Config{RootCAs: certs.Pool, Certificates: clientCerts})
+	}
+
+	// without a client cert the handshake or the first stream fails
+	cc, err := dial()
+	if err == nil {
+		_, err = do(t, cc, "GET", client.HOST_INFO, "")
+	}
+	if err == nil {
+		t.Error("served a client without a cert")
+	}
+
+	cc, err = dial(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, host, body string
+		want               int
+	}{
+		{"GET", client.HOST_INFO, "", http.StatusOK},
+		{"CONNECT", echo(t), "", http.StatusForbidden}, // DefaultDeny
+		{"CONNECT", "localhost:1", "", http.StatusForbidden},
+		{"PUT", client.HOST_PAC, testPac, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		status, err := do(t, cc, tt.method, tt.host, tt.body)
+		if err != nil || status != tt.want {
+			t.Errorf("%s %s: %d %v, want %d", tt.method, tt.host, status, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/empirefox/wsh2c/client"
+)
+
+// serveStream serves a stream of the client, the host is the target of
+// CONNECT and /r, or an inner host.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.Host, "i:"):
+		s.serveInner(w, r)
+	case r.Method == "CONNECT":
+		s.serveConnect(w, r)
+	case r.Method == "POST" && r.URL.Path == "/r":
+		s.serveReverse(w, r)
+	default:
+		http.Error(w, "unknown stream", http.StatusBadRequest)
+	}
+}
+
+func (s *Server) serveInner(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Host == client.HOST_OK:
+		w.WriteHeader(http.StatusOK)
+	case r.Host == client.HOST_INFO && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.info(isAnonymous(r)))
+	case r.Host == client.HOST_PAC && r.Method == "GET":
+		s.writePac(w, r)
+	case r.Host == client.HOST_PAC && r.Method == "PUT":
+		if isAnonymous(r) {
+			http.Error(w, "anonymous clients can not push the pac", http.StatusForbidden)
+			return
+		}
+		if err := s.putPac(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Host == client.HOST_PAC_UPDATE && r.Method == "GET":
+		if err := s.loadPac(); err != nil {
+			log.WithError(err).Errorln("reload pac")
+			http.Error(w, "reload pac failed", http.StatusInternalServerError)
+			return
+		}
+		s.writePac(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// info is the capability document of the server, anonymous clients can not
+// push the pac.
+func (s *Server) info(anonymous bool) *client.ServerInfo {
+	maxStreams := s.h2.MaxConcurrentStreams
+	if maxStreams == 0 {
+		maxStreams = defaultMaxStreams
+	}
+	features := []string{client.FEATURE_REVERSE}
+	if !anonymous {
+		features = append(features, client.FEATURE_PAC_PUSH)
+	}
+	return &client.ServerInfo{
+		Version:    client.PROTOCOL_VERSION,
+		MinVersion: MIN_CLIENT_VERSION,
+		PingSecond: s.PingSecond,
+		Features:   features,
+		MaxStreams: maxStreams,
+		PacVersion: s.pacVersion(),
+	}
+}
+
+// serveConnect tunnels the stream to r.Host.
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
+	rc, ok := s.dial(w, r.Host)
+	if !ok {
+		return
+	}
+	defer rc.Close()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	go func() {
+		io.Copy(rc, r.Body)
+		if tc, ok := rc.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	copyFlush(w, rc)
+}
+
+// serveReverse sends the raw http request in the body to r.Host, the raw
+// response is streamed back.
+func (s *Server) serveReverse(w http.ResponseWriter, r *http.Request) {
+	req, err := http.ReadRequest(bufio.NewReaderSize(r.Body, bufSize))
+	if err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Close = true
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+
+	rc, ok := s.dial(w, r.Host)
+	if !ok {
+		return
+	}
+	defer rc.Close()
+	go func() {
+		if err := req.Write(rc); err != nil {
+			rc.Close()
+		}
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	copyFlush(w, rc)
+}
+
+// dial connects to target, errors are written as 403, 502 or 504.
+func (s *Server) dial(w http.ResponseWriter, target string) (net.Conn, bool) {
+	d := net.Dialer{Timeout: s.DialTimeout, Control: s.dests.control}
+	rc, err := d.Dial("tcp", target)
+	if err != nil {
+		log.WithError(err).Debugln("dial", target)
+		status := http.StatusBadGateway
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			status = http.StatusGatewayTimeout
+		}
+		if errors.Is(err, errDenied) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+	return rc, true
+}
+
+// copyFlush copies r to w, flushing every read.
+func copyFlush(w http.ResponseWriter, r io.Reader) {
+	buf := make([]byte, bufSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/empirefox/wsh2c/client"
+	"github.com/gdamore/tcell/v2"
+)
+
+const topUsage = `usage: wsh [-admin addr] top [addr]
+
+addr is the admin api of a running wsh, like unix:/run/wsh.sock
+
+keys:
+  up/down  select a stream
+  k        kill the selected stream
+  r        reconnect the listener of the selected stream
+  R        reconnect all listeners
+  q        quit
+`
+
+// adminClient calls the admin api over tcp or a unix socket.
+type adminClient struct {
+	hc *http.Client
+	u  string
+}
+
+func newAdminClient(addr string) *adminClient {
+	if strings.HasPrefix(addr, "unix:") {
+		file := strings.TrimPrefix(addr, "unix:")
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", file)
+			},
+		}
+		return &adminClient{hc: &http.Client{Transport: tr, Timeout: 5 * time.Second}, u: "http://wsh"}
+	}
+	return &adminClient{hc: &http.Client{Timeout: 5 * time.Second}, u: "http://" + addr}
+}
+
+// do calls the api and decodes the response into v if not nil.
+func (ac *adminClient) do(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, ac.u+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(client.ADMIN_HEADER, "1")
+	res, err := ac.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s %s: %s %s", method, path, res.Status, strings.TrimSpace(string(b)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// topStream is a stream with its throughput since the last poll.
+type topStream struct {
+	client.Stream
+	rate float64 // bytes per second of both directions
+}
+
+type hostTotal struct {
+	host  string
+	bytes int64
+}
+
+type topState struct {
+	listeners []client.ListenerStatus
+	streams   []topStream
+	hosts     []hostTotal
+	errors    []client.LogEntry
+	err       error
+	updated   time.Time
+	selected  uint64 // stream id
+	message   string
+
+	last     map[uint64]int64 // total bytes of streams at the last poll
+	lastTime time.Time
+}
+
+// topSnapshot is one poll of the admin api.
+type topSnapshot struct {
+	listeners []client.ListenerStatus
+	streams   []client.Stream
+	errors    []client.LogEntry
+	traffic   *client.Counters // nil if accounting is disabled
+	err       error
+	time      time.Time
+}
+
+// pollTop calls the admin api, it may take long on a stalled daemon so it
+// runs outside of the event loop.
+func pollTop(ac *adminClient) *topSnapshot {
+	snap := &topSnapshot{}
+	snap.err = ac.do("GET", "/listeners", &snap.listeners)
+	if snap.err == nil {
+		snap.err = ac.do("GET", "/streams", &snap.streams)
+	}
+	if snap.err == nil {
+		snap.err = ac.do("GET", "/errors", &snap.errors)
+	}
+	if snap.err == nil {
+		var traffic struct {
+			Month *client.Counters `json:"month"`
+		}
+		if err := ac.do("GET", "/traffic", &traffic); err == nil {
+			snap.traffic = traffic.Month
+		}
+	}
+	snap.time = time.Now()
+	return snap
+}
+
+// apply updates the state with a snapshot.
+func (st *topState) apply(snap *topSnapshot) {
+	st.err = snap.err
+	if st.err != nil {
+		return
+	}
+
+	streams, now := snap.streams, snap.time
+	elapsed := now.Sub(st.lastTime).Seconds()
+	last := make(map[uint64]int64, len(streams))
+	st.streams = st.streams[:0]
+	for _, s := range streams {
+		total := s.Traffic.Total()
+		ts := topStream{Stream: s}
+		if prev, ok := st.last[s.ID]; ok && elapsed > 0 {
+			ts.rate = float64(total-prev) / elapsed
+		}
+		last[s.ID] = total
+		st.streams = append(st.streams, ts)
+	}
+	sort.SliceStable(st.streams, func(i, j int) bool {
+		if st.streams[i].rate != st.streams[j].rate {
+			return st.streams[i].rate > st.streams[j].rate
+		}
+		return st.streams[i].Traffic.Total() > st.streams[j].Traffic.Total()
+	})
+	st.last, st.lastTime = last, now
+
+	// this month of the Accountant, or active streams if disabled
+	hosts := make(map[string]int64)
+	if snap.traffic != nil {
+		for host, t := range snap.traffic.Hosts {
+			hosts[host] = t.Total()
+		}
+	} else {
+		for _, s := range streams {
+			host, _, err := net.SplitHostPort(s.Target)
+			if err != nil {
+				host = s.Target
+			}
+			hosts[host] += s.Traffic.Total()
+		}
+	}
+	st.hosts = st.hosts[:0]
+	for host, n := range hosts {
+		st.hosts = append(st.hosts, hostTotal{host, n})
+	}
+	sort.Slice(st.hosts, func(i, j int) bool { return st.hosts[i].bytes > st.hosts[j].bytes })
+
+	st.listeners, st.errors, st.updated = snap.listeners, snap.errors, now
+	if st.selectedIndex() < 0 && len(st.streams) > 0 {
+		st.selected = st.streams[0].ID
+	}
+}
+
+func (st *topState) selectedIndex() int {
+	for i, s := range st.streams {
+		if s.ID == st.selected {
+			return i
+		}
+	}
+	return -1
+}
+
+func (st *topState) move(d int) {
+	if len(st.streams) == 0 {
+		return
+	}
+	i := st.selectedIndex() + d
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(st.streams) {
+		i = len(st.streams) - 1
+	}
+	st.selected = st.streams[i].ID
+}
+
+// runTop shows the live dashboard of the admin api at addr.
+func runTop(args []string) int {
+	addr := *admin
+	if len(args) > 0 {
+		addr = args[0]
+	}
+	if addr == "" || len(args) > 1 {
+		fmt.Fprint(os.Stderr, topUsage)
+		return 2
+	}
+	ac := newAdminClient(addr)
+
+	screen, err := tcell.NewScreen()
+	if err == nil {
+		err = screen.Init()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "top:", err)
+		return 1
+	}
+	defer screen.Fini()
+
+	events := make(chan tcell.Event)
+	go func() {
+		for {
+			ev := screen.PollEvent()
+			if ev == nil {
+				return
+			}
+			events <- ev
+		}
+	}()
+
+	// the api is polled in the background, refresh asks for a poll now
+	snapshots := make(chan *topSnapshot)
+	refresh := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			snapshots <- pollTop(ac)
+			select {
+			case <-ticker.C:
+			case <-refresh:
+			}
+		}
+	}()
+
+	st := &topState{message: "connecting..."}
+	messages := make(chan string)
+	drawTop(screen, addr, st)
+	for {
+		select {
+		case snap := <-snapshots:
+			st.apply(snap)
+		case msg := <-messages:
+			st.message = msg
+			select {
+			case refresh <- struct{}{}:
+			default:
+			}
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case *tcell.EventResize:
+				screen.Sync()
+			case *tcell.EventKey:
+				if !topKey(ac, st, ev, messages) {
+					return 0
+				}
+			}
+		}
+		drawTop(screen, addr, st)
+	}
+}
+
+// topKey handles a key, false to quit. Admin calls run in the background and
+// send their result to messages.
+func topKey(ac *adminClient, st *topState, ev *tcell.EventKey, messages chan<- string) bool {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return false
+	case tcell.KeyUp:
+		st.move(-1)
+		return true
+	case tcell.KeyDown:
+		st.move(1)
+		return true
+	}
+
+	var method, path, msg string
+	switch ev.Rune() {
+	case 'q':
+		return false
+	case 'k':
+		if i := st.selectedIndex(); i >= 0 {
+			method, path = "DELETE", fmt.Sprintf("/streams/%d", st.selected)
+			msg = fmt.Sprintf("killed stream %d", st.selected)
+		}
+	case 'r':
+		if i := st.selectedIndex(); i >= 0 {
+			port := st.streams[i].Port
+			method, path = "POST", "/reconnect?port="+port
+			msg = "reconnected listener " + port
+		}
+	case 'R':
+		method, path = "POST", "/reconnect"
+		msg = "reconnected all listeners"
+	}
+	if method == "" {
+		return true
+	}
+	go func() {
+		if err := ac.do(method, path, nil); err != nil {
+			msg = err.Error()
+		}
+		messages <- msg
+	}()
+	return true
+}
+
+func drawTop(s tcell.Screen, addr string, st *topState) {
+	s.Clear()
+	w, h := s.Size()
+	bold := tcell.StyleDefault.Bold(true)
+	dim := tcell.StyleDefault.Dim(true)
+	red := tcell.StyleDefault.Foreground(tcell.ColorRed)
+	green := tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	selected := tcell.StyleDefault.Reverse(true)
+
+	y := 0
+	line := func(style tcell.Style, format string, a ...interface{}) {
+		if y < h {
+			drawString(s, 0, y, w, style, fmt.Sprintf(format, a...))
+		}
+		y++
+	}
+
+	line(bold, "wsh top  %s  %s", addr, st.updated.Format("15:04:05"))
+	if st.err != nil {
+		line(red, "%s", st.err)
+	} else {
+		line(dim, "%s", st.message)
+	}
+
+	y++
+	line(bold, "%-7s %-32s %5s %7s %9s %9s %9s %s", "PORT", "SERVER", "CONNS", "STREAMS", "RTT", "P90", "JITTER", "HEALTH")
+	for _, l := range st.listeners {
+		health, style := "-", tcell.StyleDefault
+		switch {
+		case l.RTT.Samples == 0:
+		case l.RTT.Healthy:
+			health, style = "ok", green
+		default:
+			health, style = fmt.Sprintf("missed %d", l.RTT.Missed), red
+		}
+		line(style, "%-7s %-32s %5d %7d %9s %9s %9s %s", l.Port, truncate(l.Server, 32), len(l.Tunnels), l.Streams,
+			fmtMs(l.RTT.EWMA), fmtMs(l.RTT.P90), fmtMs(l.RTT.Jitter), health)
+	}
+
+	y++
+	line(bold, "%-6s %-6s %-7s %-40s %10s %10s %10s %8s", "ID", "PORT", "ACTION", "TARGET", "RATE", "UP", "DOWN", "AGE")
+	rows := h - y - 12
+	if rows < 3 {
+		rows = 3
+	}
+	for i, ts := range st.streams {
+		if i >= rows {
+			line(dim, "... %d more", len(st.streams)-rows)
+			break
+		}
+		style := tcell.StyleDefault
+		if ts.ID == st.selected {
+			style = selected
+		}
+		line(style, "%-6d %-6s %-7s %-40s %9s/s %10s %10s %8s", ts.ID, ts.Port, ts.Action, truncate(ts.Target, 40),
+			fmtBytes(int64(ts.rate)), fmtBytes(ts.Traffic.Up), fmtBytes(ts.Traffic.Down), ts.Age)
+	}
+
+	y++
+	line(bold, "%-40s %10s", "HOST", "BYTES")
+	for i, ht := range st.hosts {
+		if i >= 5 {
+			break
+		}
+		line(tcell.StyleDefault, "%-40s %10s", truncate(ht.host, 40), fmtBytes(ht.bytes))
+	}
+
+	y++
+	line(bold, "RECENT ERRORS")
+	for i := len(st.errors) - 1; i >= 0 && i >= len(st.errors)-5; i-- {
+		e := st.errors[i]
+		line(red, "%s %s", e.Time.Format("15:04:05"), e.Message)
+	}
+
+	drawString(s, 0, h-1, w, dim, "up/down select  k kill  r reconnect listener  R reconnect all  q quit")
+	s.Show()
+}
+
+func drawString(s tcell.Screen, x, y, w int, style tcell.Style, str string) {
+	for _, r := range str {
+		if x >= w {
+			return
+		}
+		s.SetContent(x, y, r, nil, style)
+		x++
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "~"
+}
+
+func fmtMs(ms float64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", ms)
+}
+
+func fmtBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}